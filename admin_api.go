@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// AdminAPI is an authenticated JSON API to query and act on builds
+//
+//	GET  /api/changes/{change}/builds
+//	POST /api/changes/{change}/patchsets/{patch}/builds
+//	POST /api/builds/{build}/cancel?pipeline=slug
+//	GET  /api/events
+type AdminAPI struct {
+	token    string
+	mux      *http.ServeMux
+	Pipeline BuildPipeline
+	Backend  backend.Backend
+	Gerrit   GerritChangeQuerier
+	Events   *EventLog
+}
+
+// NewAdminAPI creates an AdminAPI accepting the bearer token in tokenPath
+func NewAdminAPI(tokenPath string, p BuildPipeline, b backend.Backend, gerrit GerritChangeQuerier, events *EventLog) (*AdminAPI, error) {
+	token, err := readToken(tokenPath)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, fmt.Errorf("admin api token in %s is empty", tokenPath)
+	}
+	api := &AdminAPI{
+		token:    token,
+		mux:      http.NewServeMux(),
+		Pipeline: p,
+		Backend:  b,
+		Gerrit:   gerrit,
+		Events:   events,
+	}
+	api.mux.HandleFunc("GET /api/changes/{change}/builds", api.getChangeBuilds)
+	api.mux.HandleFunc("POST /api/changes/{change}/patchsets/{patch}/builds", api.retriggerPatchSet)
+	api.mux.HandleFunc("POST /api/builds/{build}/cancel", api.cancelBuild)
+	api.mux.HandleFunc("GET /api/events", api.getEvents)
+	return api, nil
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		log.Warn().Str("path", r.URL.Path).Msg("Unauthorized admin api request")
+		writeJSONError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+	log.Debug().Str("method", r.Method).Str("path", r.URL.Path).Msg("Handling admin api request")
+	a.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("Failed to write admin api response")
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// pathInt parses a numeric path value
+func pathInt(r *http.Request, name string) (int, error) {
+	n, err := strconv.Atoi(r.PathValue(name))
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number: %q", name, r.PathValue(name))
+	}
+	return n, nil
+}
+
+func (a *AdminAPI) getChangeBuilds(w http.ResponseWriter, r *http.Request) {
+	change, err := pathInt(r, "change")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	builds, err := a.Backend.GetChangeBuilds(r.Context(), change)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, builds)
+}
+
+func (a *AdminAPI) retriggerPatchSet(w http.ResponseWriter, r *http.Request) {
+	change, err := pathInt(r, "change")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	patch, err := pathInt(r, "patch")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	event, err := queryPatchSetEvent(a.Gerrit, "admin-retrigger", change, patch)
+	if errors.Is(err, errPatchSetNotFound) {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+	// Builds like a new patch set so skip hashtags, topics and relation chains apply
+	if err := createChangeBuild(event.WithContext(r.Context()), a.Pipeline, a.Backend); err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, &backend.Patch{
+		Number:   event.PatchSet.Number,
+		Change:   event.Change.Number,
+		Revision: event.PatchSet.Revision,
+	})
+}
+
+func (a *AdminAPI) cancelBuild(w http.ResponseWriter, r *http.Request) {
+	buildNumber, err := pathInt(r, "build")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	pipeline := a.Pipeline
+	if slug := r.URL.Query().Get("pipeline"); slug != "" && slug != pipeline.Slug() {
+		pipeline = pipelineBySlug(slug, nil)
+		if pipeline == nil {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown pipeline %q", slug))
+			return
+		}
+	}
+	log.Info().
+		Int("buildNumber", buildNumber).
+		Str("pipeline", pipeline.Slug()).
+		Msg("Cancelling build from admin api")
+	result, err := pipeline.CancelBuild(buildNumber)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+	status := http.StatusAccepted
+	if result == CancelResultNotFound {
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, map[string]any{"buildNumber": buildNumber, "result": result})
+}
+
+func (a *AdminAPI) getEvents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.Events.Recent())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func newTestAdminAPI(t *testing.T, p MockPipeline, b MockBackend, g MockGerrit) *AdminAPI {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	api, err := NewAdminAPI(tokenPath, p, b, g, NewEventLog(10))
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	return api
+}
+
+func adminRequest(api *AdminAPI, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res := httptest.NewRecorder()
+	api.ServeHTTP(res, req)
+	return res
+}
+
+func TestAdminAPIRequiresTheToken(t *testing.T) {
+	api := newTestAdminAPI(t, NewMockPipeline(), NewMockBackend(), NewMockGerrit())
+	res := httptest.NewRecorder()
+	api.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/events", nil))
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, but got %d", res.Code)
+	}
+}
+
+func TestAdminAPIListsTheBuildsOfAChange(t *testing.T) {
+	b := NewMockBackend()
+	b.MockGetChangeBuilds = func(ctx context.Context, change int) ([]*backend.PatchBuild, error) {
+		return []*backend.PatchBuild{
+			{BuildNumber: 10, State: "passed", Patch: &backend.Patch{Number: 1, Change: change}},
+			{BuildNumber: 11, State: "running", Patch: &backend.Patch{Number: 2, Change: change}},
+		}, nil
+	}
+	api := newTestAdminAPI(t, NewMockPipeline(), b, NewMockGerrit())
+
+	res := adminRequest(api, http.MethodGet, "/api/changes/42/builds")
+	if res.Code != http.StatusOK {
+		t.Fatalf("Expected 200, but got %d: %s", res.Code, res.Body.String())
+	}
+	builds := []*backend.PatchBuild{}
+	if err := json.NewDecoder(res.Body).Decode(&builds); err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 || builds[1].State != "running" || builds[1].Change != 42 {
+		t.Errorf("Expected both builds of change 42, but got %+v", builds)
+	}
+
+	if res := adminRequest(api, http.MethodGet, "/api/changes/nope/builds"); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a non-numeric change, but got %d", res.Code)
+	}
+}
+
+func TestAdminAPIRetriggersAPatchSet(t *testing.T) {
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	g := NewMockGerrit()
+	g.MockQueryChanges = func(query string, options ...string) ([]QueriedChange, error) {
+		return []QueriedChange{{
+			Change:    Change{Number: 42, ID: "I42"},
+			PatchSets: []PatchSet{{Number: 1, Revision: "aaa"}, {Number: 2, Revision: "bbb"}},
+		}}, nil
+	}
+	var created *buildkite.CreateBuild
+	p.MockCreateBuild = func(build *buildkite.CreateBuild) (int, error) {
+		created = build
+		return 7, nil
+	}
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	withGerrit(t, g)
+	api := newTestAdminAPI(t, p, b, g)
+
+	res := adminRequest(api, http.MethodPost, "/api/changes/42/patchsets/2/builds")
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, but got %d: %s", res.Code, res.Body.String())
+	}
+	if created.Commit != "bbb" || created.Branch != "I42" {
+		t.Errorf("Expected a build of patch set 2, but got %+v", created)
+	}
+	if b.FunctionCallCounter["SaveBuild"] != 1 {
+		t.Errorf("Expected SaveBuild to be called once, but it was called %d times", b.FunctionCallCounter["SaveBuild"])
+	}
+
+	if res := adminRequest(api, http.MethodPost, "/api/changes/42/patchsets/3/builds"); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown patch set, but got %d", res.Code)
+	}
+}
+
+func TestAdminAPIRetriggersLikeANewPatchSet(t *testing.T) {
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	g := NewMockGerritChanges(map[string][]QueriedChange{
+		"change:42": {{
+			Change:    Change{Number: 42, ID: "I42", Hashtags: []string{"skip-ci"}},
+			PatchSets: []PatchSet{{Number: 1, Revision: "aaa"}},
+		}},
+	})
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	withGerrit(t, g)
+	api := newTestAdminAPI(t, p, b, g)
+
+	if res := adminRequest(api, http.MethodPost, "/api/changes/42/patchsets/1/builds"); res.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, but got %d: %s", res.Code, res.Body.String())
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Error("Expected a change with a skip hashtag not to be built")
+	}
+}
+
+func TestAdminAPICancelsABuild(t *testing.T) {
+	p := NewMockPipeline()
+	api := newTestAdminAPI(t, p, NewMockBackend(), NewMockGerrit())
+	if res := adminRequest(api, http.MethodPost, "/api/builds/7/cancel"); res.Code != http.StatusAccepted {
+		t.Errorf("Expected 202, but got %d: %s", res.Code, res.Body.String())
+	}
+	if p.FunctionCallCounter["CancelBuild"] != 1 {
+		t.Errorf("Expected CancelBuild to be called once, but it was called %d times", p.FunctionCallCounter["CancelBuild"])
+	}
+}
+
+func TestEventLogKeepsTheMostRecentEvents(t *testing.T) {
+	events := NewEventLog(2)
+	for i := 1; i <= 3; i++ {
+		event := events.Add(Event{Type: "patchset-created", Change: Change{Number: i}})
+		events.AddOutcome(event, "HandlePatchsetCreated", 0, nil)
+	}
+	recent := events.Recent()
+	if len(recent) != 2 || recent[0].Change != 3 || recent[1].Change != 2 {
+		t.Fatalf("Expected changes 3 and 2, newest first, but got %+v", recent)
+	}
+	if len(recent[0].Outcomes) != 1 || recent[0].Outcomes[0].Handler != "HandlePatchsetCreated" {
+		t.Errorf("Expected the handler outcome to be recorded, but got %+v", recent[0].Outcomes)
+	}
+}
+
+func TestParseQueryOutputSkipsStats(t *testing.T) {
+	output := []byte(`{"project":"p","number":42,"id":"I42","currentPatchSet":{"number":2,"revision":"bbb"}}
+{"type":"stats","rowCount":1,"runTimeMilliseconds":5}
+`)
+	changes, err := parseQueryOutput(output)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(changes) != 1 || changes[0].Number != 42 || changes[0].CurrentPatchSet.Revision != "bbb" {
+		t.Errorf("Expected change 42, but got %+v", changes)
+	}
+	if _, err := parseQueryOutput([]byte(`{"type":"error","message":"bad query"}`)); err == nil {
+		t.Error("Expected a query error to be returned")
+	}
+}
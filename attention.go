@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// AttentionConfig configures who is asked to act on a change when its build fails
+//
+//	attention:
+//	  on_failure: true
+//	  reason: CI failed
+//	  reviewers:
+//	    - paths: ["db/migrations/*", "deploy/"]
+//	      accounts: [dba, ops@example.com]
+type AttentionConfig struct {
+	// OnFailure adds the uploader of a failed patch set to the attention set and removes it when a build passes
+	OnFailure bool `yaml:"on_failure"`
+	// Reason is shown next to the uploader in the attention set
+	Reason string `yaml:"reason"`
+	// Reviewers are added when a failed patch set changes one of their paths
+	Reviewers []PathReviewers `yaml:"reviewers"`
+}
+
+// PathReviewers are accounts or groups reviewing changes to paths.
+// Paths are path.Match patterns. A path ending with / matches the files below it.
+type PathReviewers struct {
+	Paths    []string `yaml:"paths"`
+	Accounts []string `yaml:"accounts"`
+}
+
+func defaultAttentionConfig() AttentionConfig {
+	return AttentionConfig{
+		Reason:    "CI failed",
+		Reviewers: []PathReviewers{},
+	}
+}
+
+// Validate checks the path patterns and that every path has reviewers
+func (c AttentionConfig) Validate() error {
+	for i, reviewers := range c.Reviewers {
+		if len(reviewers.Paths) == 0 || len(reviewers.Accounts) == 0 {
+			return fmt.Errorf("attention.reviewers[%d] needs paths and accounts", i)
+		}
+		for _, pattern := range reviewers.Paths {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("attention.reviewers[%d] path %q: %w", i, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Matches checks a file is one of the paths
+func (r PathReviewers) Matches(file string) bool {
+	for _, pattern := range r.Paths {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(file, pattern) {
+			return true
+		}
+		if matched, _ := path.Match(pattern, file); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// reviewersOf returns the reviewers of the files of a patch set
+func (c AttentionConfig) reviewersOf(files []PatchSetFile) []string {
+	reviewers := []string{}
+	for _, r := range c.Reviewers {
+		matches := slices.ContainsFunc(files, func(f PatchSetFile) bool {
+			return r.Matches(f.File)
+		})
+		if !matches {
+			continue
+		}
+		for _, account := range r.Accounts {
+			if !slices.Contains(reviewers, account) {
+				reviewers = append(reviewers, account)
+			}
+		}
+	}
+	return reviewers
+}
+
+// accountID is how Gerrit is told about a user
+func accountID(u User) string {
+	if u.Username != "" {
+		return u.Username
+	}
+	return u.Email
+}
+
+// queryPatchSet returns a patch set with its uploader and files
+func queryPatchSet(r GerritReviewWriter, patch *backend.Patch) (*PatchSet, error) {
+	querier, ok := r.(GerritChangeQuerier)
+	if !ok {
+		return nil, fmt.Errorf("gerrit client cannot query changes")
+	}
+	changes, err := querier.QueryChanges(fmt.Sprintf("change:%d", patch.Change), QueryFiles)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		if change.Number != patch.Change {
+			continue
+		}
+		if ps, ok := change.GetPatchSet(patch.Number); ok {
+			return ps, nil
+		}
+	}
+	return nil, fmt.Errorf("patch set %d of change %d not found", patch.Number, patch.Change)
+}
+
+// setAttention asks the uploader and reviewers of paths to act on a failed build
+// and removes the attention the bridge added once a build passes
+func setAttention(ctx context.Context, r GerritReviewWriter, b backend.Backend, build Build, pb *backend.PatchBuild, review *Review) {
+	c := config.Attention
+	if pb.Trigger == backend.TriggerPostMerge || (!c.OnFailure && len(c.Reviewers) == 0) {
+		return
+	}
+	logger := log.With().
+		Int("change", pb.Change).
+		Int("patch", pb.Number).
+		Int("buildNumber", pb.BuildNumber).
+		Logger()
+	switch build.State {
+	case "passed":
+		accounts, err := b.GetAttention(ctx, pb.Change)
+		if err != nil {
+			logger.Err(err).Msg("Failed to find the attention set added by the bridge")
+			return
+		}
+		for _, account := range accounts {
+			review.RemoveFromAttentionSet = append(review.RemoveFromAttentionSet, AttentionSetInput{
+				User:   account,
+				Reason: "CI passed",
+			})
+		}
+	case "failed":
+		ps, err := queryPatchSet(r, pb.Patch)
+		if err != nil {
+			logger.Err(err).Msg("Failed to find the uploader and files of the patch set")
+			return
+		}
+		if uploader := accountID(ps.Uploader); c.OnFailure && uploader != "" {
+			review.AddToAttentionSet = append(review.AddToAttentionSet, AttentionSetInput{
+				User:   uploader,
+				Reason: c.Reason,
+			})
+		}
+		review.Reviewers = c.reviewersOf(ps.Files)
+	}
+}
+
+// recordAttention saves the attention set changes of a posted review
+func recordAttention(ctx context.Context, b backend.Backend, review *Review) error {
+	if len(review.RemoveFromAttentionSet) > 0 {
+		return b.ClearAttention(ctx, review.Change)
+	}
+	if len(review.AddToAttentionSet) == 0 {
+		return nil
+	}
+	accounts := []string{}
+	for _, attention := range review.AddToAttentionSet {
+		accounts = append(accounts, attention.User)
+	}
+	return b.AddAttention(ctx, review.Change, accounts...)
+}
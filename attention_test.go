@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func TestPathReviewersMatches(t *testing.T) {
+	r := PathReviewers{Paths: []string{"db/migrations/*", "deploy/"}}
+	for file, matches := range map[string]bool{
+		"db/migrations/001.sql":   true,
+		"db/migrations/old/1.sql": false,
+		"deploy/k8s/app.yaml":     true,
+		"deployment.md":           false,
+		"main.go":                 false,
+	} {
+		if r.Matches(file) != matches {
+			t.Errorf("Expected %s to match %v", file, matches)
+		}
+	}
+}
+
+func TestItAsksForAttentionOnFailure(t *testing.T) {
+	c := defaultConfig()
+	c.Attention.OnFailure = true
+	c.Attention.Reviewers = []PathReviewers{
+		{Paths: []string{"db/*"}, Accounts: []string{"dba"}},
+		{Paths: []string{"deploy/"}, Accounts: []string{"ops"}},
+	}
+	withConfig(t, c, map[string]BuildPipeline{})
+	b := NewMockBackend()
+	b.MockGetCurrentPatch = func(ctx context.Context, change int) (int, error) {
+		return 3, nil
+	}
+	webhook := NewMockWebhook(&b, "build.finished", "failed", &backend.Patch{Change: 42, Number: 3})
+	var added []string
+	b.MockAddAttention = func(ctx context.Context, change int, accounts ...string) error {
+		added = accounts
+		return nil
+	}
+	g := NewMockGerrit()
+	g.MockQueryChanges = func(query string, options ...string) ([]QueriedChange, error) {
+		if !slices.Contains(options, QueryFiles) {
+			t.Errorf("Expected the files of %s to be queried, but got %v", query, options)
+		}
+		return []QueriedChange{{
+			Change: Change{Number: 42},
+			CurrentPatchSet: &PatchSet{
+				Number:   3,
+				Uploader: User{Username: "alice"},
+				Files:    []PatchSetFile{{File: "/COMMIT_MSG"}, {File: "db/schema.sql"}},
+			},
+		}}, nil
+	}
+	var review *Review
+	g.MockSetReviewState = func(r *Review) error {
+		review = r
+		return nil
+	}
+
+	if err := handleWebhookEvent(context.Background(), webhook, g, NewMockPipeline(), b); err != nil {
+		t.Fatal(err)
+	}
+	expected := []AttentionSetInput{{User: "alice", Reason: "CI failed"}}
+	if review == nil || !reflect.DeepEqual(review.AddToAttentionSet, expected) {
+		t.Fatalf("Expected the uploader to be added to the attention set, but got %+v", review)
+	}
+	if !reflect.DeepEqual(review.Reviewers, []string{"dba"}) {
+		t.Errorf("Expected the reviewers of db/ to be added, but got %v", review.Reviewers)
+	}
+	if !reflect.DeepEqual(added, []string{"alice"}) {
+		t.Errorf("Expected the added attention to be saved, but got %v", added)
+	}
+}
+
+func TestItRemovesAttentionOnPass(t *testing.T) {
+	c := defaultConfig()
+	c.Attention.OnFailure = true
+	withConfig(t, c, map[string]BuildPipeline{})
+	b := NewMockBackend()
+	b.MockGetCurrentPatch = func(ctx context.Context, change int) (int, error) {
+		return 3, nil
+	}
+	webhook := NewMockWebhook(&b, "build.finished", "passed", &backend.Patch{Change: 42, Number: 3})
+	b.MockGetAttention = func(ctx context.Context, change int) ([]string, error) {
+		return []string{"alice"}, nil
+	}
+	g := NewMockGerrit()
+	var review *Review
+	g.MockSetReviewState = func(r *Review) error {
+		review = r
+		return nil
+	}
+
+	if err := handleWebhookEvent(context.Background(), webhook, g, NewMockPipeline(), b); err != nil {
+		t.Fatal(err)
+	}
+	expected := []AttentionSetInput{{User: "alice", Reason: "CI passed"}}
+	if review == nil || !reflect.DeepEqual(review.RemoveFromAttentionSet, expected) {
+		t.Fatalf("Expected the bridge added attention to be removed, but got %+v", review)
+	}
+	if b.FunctionCallCounter["ClearAttention"] != 1 {
+		t.Error("Expected the removed attention to be forgotten")
+	}
+	if g.FunctionCallCounter["QueryChanges"] != 0 {
+		t.Error("Expected Gerrit not to be queried for a passed build")
+	}
+}
+
+func TestItLeavesAttentionAloneByDefault(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	b := NewMockBackend()
+	b.MockGetCurrentPatch = func(ctx context.Context, change int) (int, error) {
+		return 3, nil
+	}
+	webhook := NewMockWebhook(&b, "build.finished", "failed", &backend.Patch{Change: 42, Number: 3})
+	g := NewMockGerrit()
+
+	if err := handleWebhookEvent(context.Background(), webhook, g, NewMockPipeline(), b); err != nil {
+		t.Fatal(err)
+	}
+	if g.FunctionCallCounter["QueryChanges"] != 0 || b.FunctionCallCounter["AddAttention"] != 0 {
+		t.Error("Expected the attention set not to be changed")
+	}
+}
@@ -12,10 +12,37 @@ import (
 type Backend interface {
 	// SaveBuild saves a build and patch information to the backend
 	SaveBuild(context.Context, *PatchBuild) error
-	// GetBuild retrieves a build and patch information from the backend
-	GetBuild(ctx context.Context, buildNumber int) (*PatchBuild, error)
+	// GetBuild retrieves a build of a pipeline and patch information from the backend
+	GetBuild(ctx context.Context, pipeline string, buildNumber int) (*PatchBuild, error)
 	// GetPatch retrieves a build by patch and change number from the backend
 	GetPatch(context.Context, *Patch) (*PatchBuild, error)
+	// SaveCarriedBuild records the build of an earlier patch set as the build of a later patch set which reuses its result.
+	// The build still belongs to the patch set it was created for
+	SaveCarriedBuild(ctx context.Context, patch *Patch, pb *PatchBuild) error
+	// SaveBuildState saves the last known Buildkite state of a build of a pipeline
+	SaveBuildState(ctx context.Context, pipeline string, buildNumber int, state string) error
+	// GetChangeBuilds retrieves every build of a change from the backend
+	GetChangeBuilds(ctx context.Context, change int) ([]*PatchBuild, error)
+	// SaveCurrentPatch records the latest patch set of a change
+	SaveCurrentPatch(context.Context, *Patch) error
+	// GetCurrentPatch retrieves the latest patch set number of a change. ErrPatchNotFound when it was never saved
+	GetCurrentPatch(ctx context.Context, change int) (int, error)
+	// AddAttention records accounts the bridge added to the attention set of a change
+	AddAttention(ctx context.Context, change int, accounts ...string) error
+	// GetAttention retrieves the accounts the bridge added to the attention set of a change
+	GetAttention(ctx context.Context, change int) ([]string, error)
+	// ClearAttention forgets the accounts the bridge added to the attention set of a change
+	ClearAttention(ctx context.Context, change int) error
+	// AddChildChange records a change which depends on a parent change
+	AddChildChange(ctx context.Context, parent, child int) error
+	// GetChildChanges retrieves the changes recorded as depending on a parent change
+	GetChildChanges(ctx context.Context, parent int) ([]int, error)
+	// MarkPatchWaiting records a patch set waits for the build of its parent change, false when it was already recorded
+	MarkPatchWaiting(context.Context, *Patch) (bool, error)
+	// ClaimRevision records a branch revision as built, false when it was already claimed
+	ClaimRevision(ctx context.Context, revision string) (bool, error)
+	// Ping checks the backend is reachable
+	Ping(context.Context) error
 }
 
 // Patch represents a Gerrit patch revision
@@ -31,11 +58,25 @@ type Patch struct {
 }
 
 // PatchBuild represents a Gerrit patch revision with a build number from BuildKite
+// Build numbers are only unique within a Buildkite pipeline
 type PatchBuild struct {
 	BuildNumber int
+	// Pipeline is the slug of the Buildkite pipeline the build runs on
+	Pipeline string
+	// State is the last known Buildkite state of the build. Ex: scheduled, running, passed
+	State string
+	// Trigger is what created the build when it is not a build of the patch set. Ex: post-merge
+	Trigger string
 	*Patch
 }
 
+const (
+	// TriggerPostMerge marks builds of a branch after a change was merged
+	TriggerPostMerge = "post-merge"
+	// TriggerTopic marks builds of every open change of a topic
+	TriggerTopic = "topic"
+)
+
 // NewPatch creates a new PatchBuild from a patch revision slug
 // it does not include a build number
 func NewPatch(slug string) (*Patch, error) {
@@ -60,3 +101,21 @@ func NewPatch(slug string) (*Patch, error) {
 func (pb *Patch) PatchSlug() string {
 	return fmt.Sprintf("%d_%d", pb.Number, pb.Change)
 }
+
+// BuildSlug returns the $Pipeline:$BuildNumber slug of a build
+func (pb *PatchBuild) BuildSlug() string {
+	return fmt.Sprintf("%s:%d", pb.Pipeline, pb.BuildNumber)
+}
+
+// ParseBuildSlug returns the pipeline and build number of a $Pipeline:$BuildNumber slug
+func ParseBuildSlug(slug string) (string, int, error) {
+	i := strings.LastIndex(slug, ":")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid pipeline:build slug %q", slug)
+	}
+	buildNumber, err := strconv.Atoi(slug[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid pipeline:build slug %q: %w", slug, err)
+	}
+	return slug[:i], buildNumber, nil
+}
@@ -3,7 +3,10 @@ package backend
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
@@ -11,20 +14,25 @@ import (
 
 type RedisBackend struct {
 	*redis.Client
+	// LegacyPipeline is the pipeline of the builds saved before builds were keyed by pipeline slug
+	LegacyPipeline string
 }
 
 const (
 	RedisNeverExpireTTL = 0
+	// RedisBuiltRevisionTTL is how long a built branch revision is remembered for the other event of its merge
+	RedisBuiltRevisionTTL = 24 * time.Hour
 )
 
 var (
 	ErrBuildNotFound = fmt.Errorf("build not found")
+	ErrPatchNotFound = fmt.Errorf("patch not found")
 	envRedisAddress  = "localhost:6379"
 	envRedisPassword = ""
 	envRedisDB       = "0"
 )
 
-func NewRedisBackend() *RedisBackend {
+func NewRedisBackend(legacyPipeline string) *RedisBackend {
 	redisDB, err := strconv.Atoi(envRedisDB)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to parse REDIS_DB")
@@ -35,6 +43,7 @@ func NewRedisBackend() *RedisBackend {
 			Password: envRedisPassword,
 			DB:       redisDB,
 		}),
+		legacyPipeline,
 	}
 }
 
@@ -44,51 +53,285 @@ func (b *RedisBackend) SaveBuild(ctx context.Context, pb *PatchBuild) error {
 		Int("patchNumber", pb.Number).
 		Int("change", pb.Change).
 		Int("buildNumber", pb.BuildNumber).
+		Str("pipeline", pb.Pipeline).
 		Str("patchSlug", pb.PatchSlug()).
 		Msg("Saving build patchChange and build number to redis")
-	// SET patchNumber_patchChange buildNumber
-	key := fmt.Sprintf("patchChange:%s", pb.PatchSlug())
-	if err := b.Set(ctx, key, pb.BuildNumber, RedisNeverExpireTTL).Err(); err != nil {
-		return err
+	// Post-merge builds report on a change without being the build of its patch set
+	if pb.Trigger != TriggerPostMerge {
+		// SET patchChange:patchNumber_patchChange pipeline:buildNumber
+		key := fmt.Sprintf("patchChange:%s", pb.PatchSlug())
+		if err := b.Set(ctx, key, pb.BuildSlug(), RedisNeverExpireTTL).Err(); err != nil {
+			return err
+		}
 	}
-	key = fmt.Sprintf("buildNumber:%d", pb.BuildNumber)
+	// SET buildNumber:pipeline:buildNumber patchNumber_patchChange
+	key := fmt.Sprintf("buildNumber:%s", pb.BuildSlug())
 	if err := b.Set(ctx, key, pb.PatchSlug(), RedisNeverExpireTTL).Err(); err != nil {
 		return err
 	}
+	// SADD buildPatches:pipeline:buildNumber patchNumber_patchChange
+	// Topic builds are saved for the patch set of each of their changes
+	key = fmt.Sprintf("buildPatches:%s", pb.BuildSlug())
+	if err := b.SAdd(ctx, key, pb.PatchSlug()).Err(); err != nil {
+		return err
+	}
+	// SADD changeBuilds:change pipeline:buildNumber
+	key = fmt.Sprintf("changeBuilds:%d", pb.Change)
+	if err := b.SAdd(ctx, key, pb.BuildSlug()).Err(); err != nil {
+		return err
+	}
+	if pb.Trigger != "" {
+		// SET buildTrigger:pipeline:buildNumber trigger
+		key = fmt.Sprintf("buildTrigger:%s", pb.BuildSlug())
+		if err := b.Set(ctx, key, pb.Trigger, RedisNeverExpireTTL).Err(); err != nil {
+			return err
+		}
+	}
+	if pb.State != "" {
+		return b.SaveBuildState(ctx, pb.Pipeline, pb.BuildNumber, pb.State)
+	}
 	return nil
 }
 
-// GetBuild retrieves a build and patch information from the backend
-func (b *RedisBackend) GetBuild(ctx context.Context, buildNumber int) (*PatchBuild, error) {
-	// GET build:BuildNumber
-	key := fmt.Sprintf("buildNumber:%d", buildNumber)
-	patchChangeSlug, err := b.Get(ctx, key).Result()
+// SaveCarriedBuild records the build of an earlier patch set as the build of a later patch set which reuses its result.
+// The build still belongs to the patch set it was created for
+func (b *RedisBackend) SaveCarriedBuild(ctx context.Context, patch *Patch, pb *PatchBuild) error {
+	// SET patchChange:patchNumber_patchChange pipeline:buildNumber
+	return b.Set(ctx, fmt.Sprintf("patchChange:%s", patch.PatchSlug()), pb.BuildSlug(), RedisNeverExpireTTL).Err()
+}
+
+// SaveBuildState saves the last known Buildkite state of a build of a pipeline
+func (b *RedisBackend) SaveBuildState(ctx context.Context, pipeline string, buildNumber int, state string) error {
+	key := fmt.Sprintf("buildState:%s:%d", pipeline, buildNumber)
+	return b.Set(ctx, key, state, RedisNeverExpireTTL).Err()
+}
+
+// GetChangeBuilds retrieves every build of a change from the backend
+func (b *RedisBackend) GetChangeBuilds(ctx context.Context, change int) ([]*PatchBuild, error) {
+	key := fmt.Sprintf("changeBuilds:%d", change)
+	buildSlugs, err := b.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	builds := []*PatchBuild{}
+	for _, slug := range buildSlugs {
+		pipeline, buildNumber, err := b.parseSavedBuildSlug(slug)
+		if err != nil {
+			return nil, err
+		}
+		pb, err := b.GetBuild(ctx, pipeline, buildNumber)
+		if err == nil && pb.Change != change {
+			pb.Patch, err = b.getBuildPatch(ctx, pb, change)
+		}
+		if err == ErrBuildNotFound {
+			log.Warn().
+				Int("change", change).
+				Str("buildSlug", slug).
+				Msg("Build of change not found")
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		builds = append(builds, pb)
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		if builds[i].Number != builds[j].Number {
+			return builds[i].Number < builds[j].Number
+		}
+		return builds[i].BuildSlug() < builds[j].BuildSlug()
+	})
+	return builds, nil
+}
+
+// GetBuild retrieves a build of a pipeline and patch information from the backend
+func (b *RedisBackend) GetBuild(ctx context.Context, pipeline string, buildNumber int) (*PatchBuild, error) {
+	pb := &PatchBuild{
+		BuildNumber: buildNumber,
+		Pipeline:    pipeline,
+	}
+	// GET buildNumber:pipeline:buildNumber
+	patchChangeSlug, err := b.getBuildValue(ctx, "buildNumber", pipeline, buildNumber)
 	if err == redis.Nil {
 		return nil, ErrBuildNotFound
 	}
-	patch, err := NewPatch(patchChangeSlug)
 	if err != nil {
 		return nil, err
 	}
-
-	return &PatchBuild{
-		BuildNumber: buildNumber,
-		Patch:       patch,
-	}, nil
+	pb.Patch, err = NewPatch(patchChangeSlug)
+	if err != nil {
+		return nil, err
+	}
+	pb.State, err = b.getBuildValue(ctx, "buildState", pipeline, buildNumber)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	pb.Trigger, err = b.Get(ctx, fmt.Sprintf("buildTrigger:%s", pb.BuildSlug())).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return pb, nil
 }
 
-// GetPatch retrieves a build by patch and change number from the backend
+// GetPatch retrieves the latest build by patch and change number from the backend
 func (b *RedisBackend) GetPatch(ctx context.Context, p *Patch) (*PatchBuild, error) {
 	key := fmt.Sprintf("patchChange:%s", p.PatchSlug())
-	buildNumber, err := b.Get(ctx, key).Int()
+	buildSlug, err := b.Get(ctx, key).Result()
 	if err == redis.Nil {
 		return nil, ErrBuildNotFound
 	}
 	if err != nil {
 		return nil, err
 	}
+	pipeline, buildNumber, err := b.parseSavedBuildSlug(buildSlug)
+	if err != nil {
+		return nil, err
+	}
+	state, err := b.getBuildValue(ctx, "buildState", pipeline, buildNumber)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	trigger, err := b.Get(ctx, fmt.Sprintf("buildTrigger:%s:%d", pipeline, buildNumber)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
 	return &PatchBuild{
 		BuildNumber: buildNumber,
+		Pipeline:    pipeline,
+		State:       state,
+		Trigger:     trigger,
 		Patch:       p,
 	}, nil
 }
+
+// getBuildPatch returns the latest patch set of a change a build was saved for.
+// ErrBuildNotFound when the build was not saved for the change
+func (b *RedisBackend) getBuildPatch(ctx context.Context, pb *PatchBuild, change int) (*Patch, error) {
+	slugs, err := b.SMembers(ctx, fmt.Sprintf("buildPatches:%s", pb.BuildSlug())).Result()
+	if err != nil {
+		return nil, err
+	}
+	var found *Patch
+	for _, slug := range slugs {
+		patch, err := NewPatch(slug)
+		if err != nil {
+			return nil, err
+		}
+		if patch.Change == change && (found == nil || patch.Number > found.Number) {
+			found = patch
+		}
+	}
+	if found == nil {
+		return nil, ErrBuildNotFound
+	}
+	return found, nil
+}
+
+// parseSavedBuildSlug returns the pipeline and build number of a saved $Pipeline:$BuildNumber slug
+// Builds saved before builds were keyed by pipeline slug are a bare build number of the LegacyPipeline
+func (b *RedisBackend) parseSavedBuildSlug(slug string) (string, int, error) {
+	if strings.Contains(slug, ":") {
+		return ParseBuildSlug(slug)
+	}
+	buildNumber, err := strconv.Atoi(slug)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid build slug %q: %w", slug, err)
+	}
+	return b.LegacyPipeline, buildNumber, nil
+}
+
+// getBuildValue gets prefix:pipeline:buildNumber. Builds of the LegacyPipeline fall back to the
+// prefix:buildNumber key they were saved under before builds were keyed by pipeline slug
+func (b *RedisBackend) getBuildValue(ctx context.Context, prefix, pipeline string, buildNumber int) (string, error) {
+	value, err := b.Get(ctx, fmt.Sprintf("%s:%s:%d", prefix, pipeline, buildNumber)).Result()
+	if err == redis.Nil && pipeline == b.LegacyPipeline {
+		// GET prefix:buildNumber
+		return b.Get(ctx, fmt.Sprintf("%s:%d", prefix, buildNumber)).Result()
+	}
+	return value, err
+}
+
+// SaveCurrentPatch records the latest patch set of a change
+func (b *RedisBackend) SaveCurrentPatch(ctx context.Context, p *Patch) error {
+	// SET currentPatch:change patchNumber
+	key := fmt.Sprintf("currentPatch:%d", p.Change)
+	return b.Set(ctx, key, p.Number, RedisNeverExpireTTL).Err()
+}
+
+// GetCurrentPatch retrieves the latest patch set number of a change
+func (b *RedisBackend) GetCurrentPatch(ctx context.Context, change int) (int, error) {
+	patch, err := b.Get(ctx, fmt.Sprintf("currentPatch:%d", change)).Int()
+	if err == redis.Nil {
+		return 0, ErrPatchNotFound
+	}
+	return patch, err
+}
+
+// AddAttention records accounts the bridge added to the attention set of a change
+func (b *RedisBackend) AddAttention(ctx context.Context, change int, accounts ...string) error {
+	if len(accounts) == 0 {
+		return nil
+	}
+	// SADD attention:change account...
+	members := make([]any, len(accounts))
+	for i, account := range accounts {
+		members[i] = account
+	}
+	return b.SAdd(ctx, fmt.Sprintf("attention:%d", change), members...).Err()
+}
+
+// GetAttention retrieves the accounts the bridge added to the attention set of a change
+func (b *RedisBackend) GetAttention(ctx context.Context, change int) ([]string, error) {
+	accounts, err := b.SMembers(ctx, fmt.Sprintf("attention:%d", change)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(accounts)
+	return accounts, nil
+}
+
+// ClearAttention forgets the accounts the bridge added to the attention set of a change
+func (b *RedisBackend) ClearAttention(ctx context.Context, change int) error {
+	return b.Del(ctx, fmt.Sprintf("attention:%d", change)).Err()
+}
+
+// AddChildChange records a change which depends on a parent change
+func (b *RedisBackend) AddChildChange(ctx context.Context, parent, child int) error {
+	// SADD childChanges:parent child
+	return b.SAdd(ctx, fmt.Sprintf("childChanges:%d", parent), child).Err()
+}
+
+// GetChildChanges retrieves the changes recorded as depending on a parent change
+func (b *RedisBackend) GetChildChanges(ctx context.Context, parent int) ([]int, error) {
+	members, err := b.SMembers(ctx, fmt.Sprintf("childChanges:%d", parent)).Result()
+	if err != nil {
+		return nil, err
+	}
+	children := []int{}
+	for _, member := range members {
+		child, err := strconv.Atoi(member)
+		if err != nil {
+			return nil, fmt.Errorf("invalid child change %q of change %d: %w", member, parent, err)
+		}
+		children = append(children, child)
+	}
+	sort.Ints(children)
+	return children, nil
+}
+
+// MarkPatchWaiting records a patch set waits for the build of its parent change, false when it was already recorded
+func (b *RedisBackend) MarkPatchWaiting(ctx context.Context, patch *Patch) (bool, error) {
+	// SET waitingPatch:patchSlug 1 NX
+	return b.SetNX(ctx, fmt.Sprintf("waitingPatch:%s", patch.PatchSlug()), 1, RedisNeverExpireTTL).Result()
+}
+
+// ClaimRevision records a branch revision as built, false when it was already claimed
+func (b *RedisBackend) ClaimRevision(ctx context.Context, revision string) (bool, error) {
+	// SET builtRevision:revision 1 NX
+	return b.SetNX(ctx, fmt.Sprintf("builtRevision:%s", revision), 1, RedisBuiltRevisionTTL).Result()
+}
+
+// Ping checks redis is reachable
+func (b *RedisBackend) Ping(ctx context.Context) error {
+	return b.Client.Ping(ctx).Err()
+}
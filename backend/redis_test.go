@@ -0,0 +1,235 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisBackend returns a backend on an in-memory redis whose legacy builds are of legacy-pipeline
+func newTestRedisBackend(t *testing.T) (*RedisBackend, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return &RedisBackend{Client: client, LegacyPipeline: "legacy-pipeline"}, server
+}
+
+func TestItSavesBuildsByPipelineAndPatchSet(t *testing.T) {
+	b, server := newTestRedisBackend(t)
+	ctx := context.Background()
+	pb := &PatchBuild{BuildNumber: 7, Pipeline: "app", State: "running", Patch: &Patch{Number: 2, Change: 42}}
+	if err := b.SaveBuild(ctx, pb); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range map[string]string{
+		"patchChange:2_42":  "app:7",
+		"buildNumber:app:7": "2_42",
+		"buildState:app:7":  "running",
+	} {
+		if got, _ := server.Get(key); got != value {
+			t.Errorf("Expected %s to be %q, but got %q", key, value, got)
+		}
+	}
+	if members, _ := server.Members("changeBuilds:42"); !reflect.DeepEqual(members, []string{"app:7"}) {
+		t.Errorf("Expected change 42 to index build app:7, but got %v", members)
+	}
+
+	got, err := b.GetBuild(ctx, "app", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Change != 42 || got.Number != 2 || got.State != "running" {
+		t.Errorf("Unexpected build %+v", got)
+	}
+	if _, err := b.GetBuild(ctx, "other", 7); !errors.Is(err, ErrBuildNotFound) {
+		t.Errorf("Expected build 7 of another pipeline not to be found, but got %v", err)
+	}
+	got, err = b.GetPatch(ctx, &Patch{Number: 2, Change: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.BuildNumber != 7 || got.Pipeline != "app" {
+		t.Errorf("Unexpected build of patch set 2 %+v", got)
+	}
+}
+
+func TestItSavesTheTriggerOfABuild(t *testing.T) {
+	b, server := newTestRedisBackend(t)
+	ctx := context.Background()
+	pb := &PatchBuild{BuildNumber: 8, Pipeline: "trunk", Trigger: TriggerPostMerge, Patch: &Patch{Number: 3, Change: 42}}
+	if err := b.SaveBuild(ctx, pb); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := server.Get("buildTrigger:trunk:8"); got != TriggerPostMerge {
+		t.Errorf("Expected the trigger to be saved, but got %q", got)
+	}
+	// Post-merge builds are not the build of the patch set of the merged change
+	if server.Exists("patchChange:3_42") {
+		t.Error("Expected a post-merge build not to be saved for the patch set")
+	}
+	got, err := b.GetBuild(ctx, "trunk", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Trigger != TriggerPostMerge {
+		t.Errorf("Expected a post-merge build, but got %+v", got)
+	}
+}
+
+func TestItIndexesTheBuildsOfAChange(t *testing.T) {
+	b, _ := newTestRedisBackend(t)
+	ctx := context.Background()
+	for _, pb := range []*PatchBuild{
+		{BuildNumber: 9, Pipeline: "app", State: "passed", Patch: &Patch{Number: 2, Change: 42}},
+		{BuildNumber: 3, Pipeline: "full", State: "running", Patch: &Patch{Number: 1, Change: 42}},
+		// A topic build saved for change 43 and then for change 42
+		{BuildNumber: 10, Pipeline: "app", Trigger: TriggerTopic, Patch: &Patch{Number: 5, Change: 43}},
+		{BuildNumber: 10, Pipeline: "app", Trigger: TriggerTopic, Patch: &Patch{Number: 3, Change: 42}},
+	} {
+		if err := b.SaveBuild(ctx, pb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	builds, err := b.GetChangeBuilds(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slugs := []string{}
+	for _, pb := range builds {
+		slugs = append(slugs, pb.BuildSlug()+"@"+pb.PatchSlug())
+	}
+	if expected := []string{"full:3@1_42", "app:9@2_42", "app:10@3_42"}; !reflect.DeepEqual(slugs, expected) {
+		t.Errorf("Expected %v, but got %v", expected, slugs)
+	}
+	// The topic build is found for the patch set of change 43 it was saved for
+	builds, err = b.GetChangeBuilds(ctx, 43)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].Change != 43 || builds[0].Number != 5 || builds[0].Trigger != TriggerTopic {
+		t.Errorf("Expected topic build 10 of patch set 5 of change 43, but got %+v", builds)
+	}
+}
+
+func TestItReadsBuildsSavedBeforePipelineSlugs(t *testing.T) {
+	b, server := newTestRedisBackend(t)
+	ctx := context.Background()
+	server.Set("buildNumber:7", "1_42")
+	server.Set("buildState:7", "failed")
+	server.Set("patchChange:1_42", "7")
+	server.SAdd("changeBuilds:42", "7")
+
+	got, err := b.GetPatch(ctx, &Patch{Number: 1, Change: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Pipeline != "legacy-pipeline" || got.BuildNumber != 7 || got.State != "failed" {
+		t.Errorf("Expected legacy build 7, but got %+v", got)
+	}
+	builds, err := b.GetChangeBuilds(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].Number != 1 || builds[0].Pipeline != "legacy-pipeline" {
+		t.Errorf("Expected legacy build 7 of patch set 1, but got %+v", builds)
+	}
+}
+
+func TestItRecordsCarriedBuildsForTheirNewPatchSet(t *testing.T) {
+	b, server := newTestRedisBackend(t)
+	ctx := context.Background()
+	prev := &PatchBuild{BuildNumber: 12, Pipeline: "app", State: "passed", Patch: &Patch{Number: 2, Change: 42}}
+	if err := b.SaveBuild(ctx, prev); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SaveCarriedBuild(ctx, &Patch{Number: 3, Change: 42}, prev); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := b.GetPatch(ctx, &Patch{Number: 3, Change: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.BuildNumber != 12 || got.State != "passed" {
+		t.Errorf("Expected build 12 to be the build of patch set 3, but got %+v", got)
+	}
+	// The build still belongs to patch set 2
+	if slug, _ := server.Get("buildNumber:app:12"); slug != "2_42" {
+		t.Errorf("Expected build 12 to keep patch set 2, but got %q", slug)
+	}
+	if members, _ := server.Members("buildPatches:app:12"); !reflect.DeepEqual(members, []string{"2_42"}) {
+		t.Errorf("Expected build 12 to only be saved for patch set 2, but got %v", members)
+	}
+}
+
+func TestItRecordsChildChanges(t *testing.T) {
+	b, server := newTestRedisBackend(t)
+	ctx := context.Background()
+	for _, child := range []int{44, 43, 44} {
+		if err := b.AddChildChange(ctx, 42, child); err != nil {
+			t.Fatal(err)
+		}
+	}
+	children, err := b.GetChildChanges(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(children, []int{43, 44}) {
+		t.Errorf("Expected children 43 and 44, but got %v", children)
+	}
+	if children, err := b.GetChildChanges(ctx, 41); err != nil || len(children) != 0 {
+		t.Errorf("Expected no children of change 41, but got %v, %v", children, err)
+	}
+
+	server.SAdd("childChanges:40", "nope")
+	if _, err := b.GetChildChanges(ctx, 40); err == nil {
+		t.Error("Expected an invalid child change to be an error")
+	}
+}
+
+func TestItClaimsRevisionsOnce(t *testing.T) {
+	b, server := newTestRedisBackend(t)
+	ctx := context.Background()
+	for i, expected := range []bool{true, false} {
+		claimed, err := b.ClaimRevision(ctx, "abc123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != expected {
+			t.Errorf("Expected claim %d to be %v", i+1, expected)
+		}
+	}
+	if ttl := server.TTL("builtRevision:abc123"); ttl != RedisBuiltRevisionTTL {
+		t.Errorf("Expected the claim to expire after %s, but got %s", RedisBuiltRevisionTTL, ttl)
+	}
+	// The claim is forgotten once the other event of the merge could have arrived
+	server.FastForward(RedisBuiltRevisionTTL)
+	if claimed, _ := b.ClaimRevision(ctx, "abc123"); !claimed {
+		t.Error("Expected an expired claim to be claimed again")
+	}
+}
+
+func TestItMarksWaitingPatchSetsOnce(t *testing.T) {
+	b, _ := newTestRedisBackend(t)
+	ctx := context.Background()
+	patch := &Patch{Number: 1, Change: 43}
+	for i, expected := range []bool{true, false} {
+		first, err := b.MarkPatchWaiting(ctx, patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != expected {
+			t.Errorf("Expected mark %d to be %v", i+1, expected)
+		}
+	}
+	if first, _ := b.MarkPatchWaiting(ctx, &Patch{Number: 2, Change: 43}); !first {
+		t.Error("Expected the next patch set to be marked separately")
+	}
+}
@@ -6,11 +6,34 @@ export CGO_ENABLED=0
 
 go mod download
 go build -o gerrit-event-handler \
+    admin_api.go \
+    attention.go \
+    build_outcomes.go \
+    build_templates.go \
     buildkite_webhook_handler.go \
     buildkite.go \
+    carry_forward.go \
+    change_lifecycle.go \
+    cli.go \
+    comment_commands.go \
+    comment_parser.go \
+    config.go \
+    dependencies.go \
+    event_log.go \
     gerrit_event_handlers.go \
+    gerrit_query.go \
     gerrit_ssh_client.go \
     gerrit.go \
+    hashtags.go \
+    health.go \
     main.go \
+    metrics.go \
+    notify.go \
     pipeline.go \
-    push_to_remote.go
+    post_merge.go \
+    push_to_remote.go \
+    review_messages.go \
+    stale_results.go \
+    topic_builds.go \
+    tracing.go \
+    vote_triggers.go
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Job is a job of a Buildkite build
+type Job struct {
+	ID         string `json:"id,omitempty"`
+	Type       string `json:"type,omitempty"`
+	Name       string `json:"name,omitempty"`
+	State      string `json:"state,omitempty"`
+	SoftFailed bool   `json:"soft_failed,omitempty"`
+}
+
+// Vote policies of builds which did not pass or fail
+const (
+	// VotePolicyReset resets the vote to 0
+	VotePolicyReset = "reset"
+	// VotePolicyOmit posts the result without changing the vote
+	VotePolicyOmit = "omit"
+	// VotePolicyPass votes as if the build passed
+	VotePolicyPass = "pass"
+)
+
+// ResultsConfig configures the vote of builds which neither passed nor failed
+//
+//	results:
+//	  canceled: omit
+//	  soft_failed: reset
+//	  stale: drop
+type ResultsConfig struct {
+	// Canceled is the vote policy of canceled builds: reset or omit
+	Canceled string `yaml:"canceled"`
+	// SoftFailed is the vote policy of passed builds with soft failed jobs: pass, reset or omit
+	SoftFailed string `yaml:"soft_failed"`
+	// Stale is the policy of results of superseded patch sets: message or drop
+	Stale string `yaml:"stale"`
+}
+
+func defaultResultsConfig() ResultsConfig {
+	return ResultsConfig{
+		Canceled:   VotePolicyReset,
+		SoftFailed: VotePolicyPass,
+		Stale:      StalePolicyMessage,
+	}
+}
+
+// Validate checks the vote policies
+func (c ResultsConfig) Validate() error {
+	if !slices.Contains([]string{VotePolicyReset, VotePolicyOmit}, c.Canceled) {
+		return fmt.Errorf("results.canceled must be %s or %s but got %q", VotePolicyReset, VotePolicyOmit, c.Canceled)
+	}
+	if !slices.Contains([]string{VotePolicyPass, VotePolicyReset, VotePolicyOmit}, c.SoftFailed) {
+		return fmt.Errorf("results.soft_failed must be %s, %s or %s but got %q", VotePolicyPass, VotePolicyReset, VotePolicyOmit, c.SoftFailed)
+	}
+	if !slices.Contains([]string{StalePolicyMessage, StalePolicyDrop}, c.Stale) {
+		return fmt.Errorf("results.stale must be %s or %s but got %q", StalePolicyMessage, StalePolicyDrop, c.Stale)
+	}
+	return nil
+}
+
+// BuildOutcome is how the state of a finished build is reported to Gerrit
+type BuildOutcome struct {
+	// Result names the outcome in review messages. Ex: Passed
+	Result   string
+	Vote     int
+	OmitVote bool
+}
+
+// outcomeWithPolicy is the outcome of a build which neither passed nor failed
+func outcomeWithPolicy(result, policy string) BuildOutcome {
+	switch policy {
+	case VotePolicyPass:
+		return BuildOutcome{Result: result, Vote: ReviewStateVerified}
+	case VotePolicyReset:
+		return BuildOutcome{Result: result, Vote: ReviewStateUnverified}
+	}
+	return BuildOutcome{Result: result, OmitVote: true}
+}
+
+// softFailed checks a build has a soft failed job
+func softFailed(build Build) bool {
+	return slices.ContainsFunc(build.Jobs, func(job Job) bool {
+		return job.SoftFailed
+	})
+}
+
+// buildOutcome maps every Buildkite build state to a Gerrit outcome
+func buildOutcome(build Build) BuildOutcome {
+	switch build.State {
+	case "passed":
+		if softFailed(build) {
+			return outcomeWithPolicy("Soft failed", config.Results.SoftFailed)
+		}
+		return BuildOutcome{Result: "Passed", Vote: ReviewStateVerified}
+	case "failed":
+		return BuildOutcome{Result: "Failed", Vote: ReviewStateRejected}
+	case "canceled", "canceling":
+		return outcomeWithPolicy("Canceled", config.Results.Canceled)
+	case "skipped":
+		return BuildOutcome{Result: "Skipped", OmitVote: true}
+	case "not_run":
+		return BuildOutcome{Result: "Not run", OmitVote: true}
+	case "blocked":
+		// Finished at a block step which was never unblocked
+		return BuildOutcome{Result: "Blocked", OmitVote: true}
+	case "scheduled", "running", "failing", "creating":
+		// Not finished so the vote is left as it is
+		return BuildOutcome{Result: "Running", OmitVote: true}
+	}
+	return BuildOutcome{Result: fmt.Sprintf("Unknown state %q", build.State), OmitVote: true}
+}
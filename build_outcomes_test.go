@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBuildOutcome(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	for _, tc := range []struct {
+		build    Build
+		expected BuildOutcome
+	}{
+		{Build{State: "passed"}, BuildOutcome{Result: "Passed", Vote: ReviewStateVerified}},
+		{Build{State: "failed"}, BuildOutcome{Result: "Failed", Vote: ReviewStateRejected}},
+		{Build{State: "canceled"}, BuildOutcome{Result: "Canceled", Vote: ReviewStateUnverified}},
+		{Build{State: "skipped"}, BuildOutcome{Result: "Skipped", OmitVote: true}},
+		{Build{State: "not_run"}, BuildOutcome{Result: "Not run", OmitVote: true}},
+		{Build{State: "blocked"}, BuildOutcome{Result: "Blocked", OmitVote: true}},
+		{Build{State: "passed", Jobs: []Job{{State: "passed"}, {State: "failed", SoftFailed: true}}}, BuildOutcome{Result: "Soft failed", Vote: ReviewStateVerified}},
+	} {
+		if outcome := buildOutcome(tc.build); outcome != tc.expected {
+			t.Errorf("buildOutcome(%s) = %+v; expected %+v", tc.build.State, outcome, tc.expected)
+		}
+	}
+}
+
+func TestBuildOutcomePolicies(t *testing.T) {
+	c := defaultConfig()
+	c.Results = ResultsConfig{Canceled: VotePolicyOmit, SoftFailed: VotePolicyReset}
+	withConfig(t, c, map[string]BuildPipeline{})
+
+	if outcome := buildOutcome(Build{State: "canceled"}); !outcome.OmitVote {
+		t.Errorf("Expected a canceled build to omit the vote, but got %+v", outcome)
+	}
+	softFailedBuild := Build{State: "passed", Jobs: []Job{{SoftFailed: true}}}
+	if outcome := buildOutcome(softFailedBuild); outcome.OmitVote || outcome.Vote != ReviewStateUnverified {
+		t.Errorf("Expected a soft failed build to reset the vote, but got %+v", outcome)
+	}
+
+	c.Results.Canceled = VotePolicyPass
+	if err := c.Validate(); err == nil {
+		t.Error("Expected canceled builds not to be allowed to pass")
+	}
+}
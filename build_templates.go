@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/rs/zerolog/log"
+)
+
+// BuildConfig configures the message, environment and meta-data of builds of patch sets.
+// Values are text/template templates executed with the Gerrit Event. An empty value removes a default.
+//
+//	build:
+//	  message: "{{ .Change.Subject }}"
+//	  env:
+//	    GERRIT_CHANGE_OWNER_EMAIL: "{{ .Change.Owner.Email }}"
+//	    GERRIT_TOPIC: ""
+//	  meta_data:
+//	    gerrit_url: "{{ .Change.URL }}"
+type BuildConfig struct {
+	Message  string            `yaml:"message"`
+	Env      map[string]string `yaml:"env"`
+	MetaData map[string]string `yaml:"meta_data"`
+}
+
+// defaultBuildConfig uses the variable names of the Jenkins Gerrit Trigger plugin
+// so pipelines migrated from Jenkins keep working
+func defaultBuildConfig() BuildConfig {
+	return BuildConfig{
+		Message: "{{ .Change.Subject }}",
+		Env: map[string]string{
+			"GERRIT_REFSPEC":           "{{ .PatchSet.Ref }}",
+			"GERRIT_CHANGE_NUMBER":     "{{ .Change.Number }}",
+			"GERRIT_CHANGE_ID":         "{{ .Change.ID }}",
+			"GERRIT_CHANGE_SUBJECT":    "{{ .Change.Subject }}",
+			"GERRIT_CHANGE_URL":        "{{ .Change.URL }}",
+			"GERRIT_PATCHSET_NUMBER":   "{{ .PatchSet.Number }}",
+			"GERRIT_PATCHSET_REVISION": "{{ .PatchSet.Revision }}",
+			"GERRIT_PROJECT":           "{{ .Change.Project }}",
+			"GERRIT_BRANCH":            "{{ .Change.Branch }}",
+			"GERRIT_TOPIC":             "{{ .Change.Topic }}",
+			"GERRIT_EVENT_TYPE":        "{{ .Type }}",
+		},
+		// The patch set of every build is recorded in its meta-data by tagBuildPatch
+		MetaData: map[string]string{},
+	}
+}
+
+// parseBuildTemplate parses a template of the build configuration
+func parseBuildTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+// Validate checks every template parses and renders for an empty event
+func (c BuildConfig) Validate() error {
+	check := func(name, text string) error {
+		if _, err := renderBuildTemplate(name, text, Event{}); err != nil {
+			return fmt.Errorf("build %s: %w", name, err)
+		}
+		return nil
+	}
+	if err := check("message", c.Message); err != nil {
+		return err
+	}
+	for name, text := range c.Env {
+		if err := check("env."+name, text); err != nil {
+			return err
+		}
+	}
+	for name, text := range c.MetaData {
+		if err := check("meta_data."+name, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderBuildTemplate executes a template of the build configuration for an event
+func renderBuildTemplate(name, text string, event Event) (string, error) {
+	tmpl, err := parseBuildTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	out := &strings.Builder{}
+	if err := tmpl.Execute(out, event); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// renderBuildTemplates executes the templates of a map for an event. Empty templates are left out.
+func renderBuildTemplates(kind string, templates map[string]string, event Event) map[string]string {
+	rendered := map[string]string{}
+	for name, text := range templates {
+		if text == "" {
+			continue
+		}
+		value, err := renderBuildTemplate(kind+"."+name, text, event)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("template", kind+"."+name).
+				Int("change", event.Change.Number).
+				Msg("Failed to render build template")
+			continue
+		}
+		rendered[name] = value
+	}
+	return rendered
+}
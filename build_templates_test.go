@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestItDescribesBuildsWithGerritVariables(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	event := Event{
+		Type: "patchset-created",
+		Change: Change{
+			Number:  42,
+			ID:      "I123",
+			Project: "my-project",
+			Branch:  "main",
+			Subject: "Fix the thing",
+			URL:     "https://gerrit/c/my-project/+/42",
+			Topic:   "things",
+		},
+		PatchSet: PatchSet{Number: 3, Revision: "abc123", Ref: "refs/changes/42/42/3"},
+	}
+	build := newCreateBuild(event)
+	if build.Message != "Fix the thing" {
+		t.Errorf("Expected the subject as the message, but got %q", build.Message)
+	}
+	for name, expected := range map[string]string{
+		"GERRIT_REFSPEC":         "refs/changes/42/42/3",
+		"GERRIT_CHANGE_NUMBER":   "42",
+		"GERRIT_PATCHSET_NUMBER": "3",
+		"GERRIT_PROJECT":         "my-project",
+		"GERRIT_BRANCH":          "main",
+		"GERRIT_CHANGE_URL":      "https://gerrit/c/my-project/+/42",
+		"GERRIT_TOPIC":           "things",
+	} {
+		if build.Env[name] != expected {
+			t.Errorf("Expected %s=%q, but got %q", name, expected, build.Env[name])
+		}
+	}
+	if _, err := createAndSaveBuild(NewMockPipeline(), NewMockBackend(), event, build); err != nil {
+		t.Fatal(err)
+	}
+	if build.MetaData["gerrit_change"] != "42" || build.MetaData["gerrit_patchset"] != "3" || build.MetaData["gerrit_project"] != "my-project" {
+		t.Errorf("Unexpected meta-data %v", build.MetaData)
+	}
+}
+
+func TestItMergesConfiguredBuildTemplates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `
+build:
+  message: "{{ .Change.Project }}: {{ .Change.Subject }}"
+  env:
+    GERRIT_TOPIC: ""
+    OWNER: "{{ .Change.Owner.Email }}"
+`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, c, map[string]BuildPipeline{})
+
+	build := newCreateBuild(Event{Change: Change{Project: "p", Subject: "s", Topic: "t", Owner: User{Email: "jane@example.com"}}})
+	if build.Message != "p: s" {
+		t.Errorf("Expected the configured message, but got %q", build.Message)
+	}
+	if _, ok := build.Env["GERRIT_TOPIC"]; ok {
+		t.Error("Expected an empty template to remove GERRIT_TOPIC")
+	}
+	if build.Env["OWNER"] != "jane@example.com" || build.Env["GERRIT_PROJECT"] != "p" {
+		t.Errorf("Expected configured and default env, but got %v", build.Env)
+	}
+}
+
+func TestItRejectsInvalidBuildTemplates(t *testing.T) {
+	c := defaultConfig()
+	c.Build.Env["BROKEN"] = "{{ .Change.Nope }}"
+	if err := c.Validate(); err == nil {
+		t.Error("Expected an unknown field to be rejected")
+	}
+}
@@ -9,26 +9,36 @@ type BuildkiteChange struct {
 }
 
 type Build struct {
-	ID           string           `json:"id,omitempty"`
-	GraphqlId    string           `json:"graphql_id,omitempty"`
-	URL          string           `json:"url,omitempty"`
-	WebURL       string           `json:"web_url,omitempty"`
-	Number       int              `json:"number,omitempty"`
-	State        string           `json:"state,omitempty"`
-	Blocked      bool             `json:"blocked,omitempty"`
-	BlockedState string           `json:"blocked_state,omitempty"`
-	Message      string           `json:"message,omitempty"`
-	Commit       string           `json:"commit"`
-	Branch       string           `json:"branch"`
-	Source       string           `json:"source,omitempty"`
-	CreatedAt    string           `json:"created_at,omitempty"`
-	ScheduledAt  string           `json:"scheduled_at,omitempty"`
-	StartedAt    string           `json:"started_at,omitempty"`
-	FinishedAt   string           `json:"finished_at,omitempty"`
-	RebuiltFrom  *BuildkiteChange `json:"rebuilt_from,omitempty"`
+	ID           string            `json:"id,omitempty"`
+	GraphqlId    string            `json:"graphql_id,omitempty"`
+	URL          string            `json:"url,omitempty"`
+	WebURL       string            `json:"web_url,omitempty"`
+	Number       int               `json:"number,omitempty"`
+	State        string            `json:"state,omitempty"`
+	Blocked      bool              `json:"blocked,omitempty"`
+	BlockedState string            `json:"blocked_state,omitempty"`
+	Message      string            `json:"message,omitempty"`
+	Commit       string            `json:"commit"`
+	Branch       string            `json:"branch"`
+	Source       string            `json:"source,omitempty"`
+	CreatedAt    string            `json:"created_at,omitempty"`
+	ScheduledAt  string            `json:"scheduled_at,omitempty"`
+	StartedAt    string            `json:"started_at,omitempty"`
+	FinishedAt   string            `json:"finished_at,omitempty"`
+	RebuiltFrom  *BuildkiteChange  `json:"rebuilt_from,omitempty"`
+	MetaData     map[string]string `json:"meta_data,omitempty"`
+	Env          map[string]any    `json:"env,omitempty"`
+	Jobs         []Job             `json:"jobs,omitempty"`
+}
+
+type BuildkitePipeline struct {
+	ID   string `json:"id,omitempty"`
+	Slug string `json:"slug"`
+	Name string `json:"name,omitempty"`
 }
 
 type BuildkiteWebhook struct {
-	Event string `json:"event"`
-	Build Build  `json:"build"`
+	Event    string            `json:"event"`
+	Build    Build             `json:"build"`
+	Pipeline BuildkitePipeline `json:"pipeline"`
 }
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/mrmod/gerrit-buildkite/backend"
@@ -92,86 +94,241 @@ func (h *BuildkiteWebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
-	h.HookEvents <- webhook
-	w.WriteHeader(http.StatusOK)
+	// Never block the request on a busy consumer. Buildkite is told to back off instead
+	select {
+	case h.HookEvents <- webhook:
+		w.WriteHeader(http.StatusOK)
+	default:
+		log.Warn().
+			Str("webhookEvent", webhook.Event).
+			Int("webhookBuildNumber", webhook.Build.Number).
+			Msg("Webhook queue full, rejecting webhook")
+		metricWebhooksHandled.WithLabelValues(webhook.Event, "rejected").Inc()
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "Webhook queue full", http.StatusServiceUnavailable)
+	}
+}
+
+const (
+	metaDataChange   = "gerrit_change"
+	metaDataPatchSet = "gerrit_patchset"
+	metaDataProject  = "gerrit_project"
+	metaDataTrigger  = "gerrit_trigger"
+)
+
+// tagBuildPatch records the patch set a build reports on in its meta-data
+// so the build can be related to it when the backend has lost the build
+func tagBuildPatch(metaData map[string]string, pb *backend.PatchBuild, project string) {
+	metaData[metaDataChange] = strconv.Itoa(pb.Patch.Change)
+	metaData[metaDataPatchSet] = strconv.Itoa(pb.Patch.Number)
+	metaData[metaDataProject] = project
+	if pb.Trigger != "" {
+		metaData[metaDataTrigger] = pb.Trigger
+	}
+}
+
+// buildPatch reads the patch set a build reports on from its meta-data, or env for builds
+// created with GERRIT_CHANGE_NUMBER and GERRIT_PATCHSET_NUMBER
+func buildPatch(pipeline string, build *Build) (*backend.PatchBuild, bool) {
+	value := func(metaDataKey, envKey string) string {
+		if v, ok := build.MetaData[metaDataKey]; ok {
+			return v
+		}
+		if v, ok := build.Env[envKey]; ok {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+	change, err := strconv.Atoi(value(metaDataChange, "GERRIT_CHANGE_NUMBER"))
+	if err != nil {
+		return nil, false
+	}
+	patch, err := strconv.Atoi(value(metaDataPatchSet, "GERRIT_PATCHSET_NUMBER"))
+	if err != nil {
+		return nil, false
+	}
+	return &backend.PatchBuild{
+		BuildNumber: build.Number,
+		Pipeline:    pipeline,
+		State:       build.State,
+		Trigger:     build.MetaData[metaDataTrigger],
+		Patch:       &backend.Patch{Number: patch, Change: change, Revision: build.Commit},
+	}, true
+}
+
+// lookupPatchBuild finds the patch set of a webhook build. The backend is only a cache:
+// when it lost the build, the patch set is read from the webhook payload or the build fetched from Buildkite
+// and saved back to the backend.
+func lookupPatchBuild(ctx context.Context, p BuildPipeline, b backend.Backend, webhook BuildkiteWebhook) (*backend.PatchBuild, error) {
+	pb, err := b.GetBuild(ctx, webhook.Pipeline.Slug, webhook.Build.Number)
+	if err == nil && pb != nil {
+		return pb, nil
+	}
+	log.Warn().
+		Err(err).
+		Str("pipeline", webhook.Pipeline.Slug).
+		Int("webhookBuildNumber", webhook.Build.Number).
+		Msg("Build not in backend, recovering its patch set from Buildkite")
+	pb, ok := buildPatch(webhook.Pipeline.Slug, &webhook.Build)
+	if !ok {
+		// Build numbers of other pipelines would fetch an unrelated build of the default pipeline
+		pipeline, registered := registeredPipeline(webhook.Pipeline.Slug, p)
+		if !registered {
+			return nil, fmt.Errorf("build %d of unregistered pipeline %s: %w", webhook.Build.Number, webhook.Pipeline.Slug, errUnknownBuild)
+		}
+		build, fetchErr := pipeline.GetBuild(webhook.Build.Number)
+		if fetchErr != nil {
+			return nil, errors.Join(err, fetchErr)
+		}
+		if pb, ok = buildPatch(webhook.Pipeline.Slug, build); !ok {
+			return nil, fmt.Errorf("build %d of %s has no Gerrit patch set: %w", webhook.Build.Number, webhook.Pipeline.Slug, errUnknownBuild)
+		}
+	}
+	if saveErr := b.SaveBuild(ctx, pb); saveErr != nil {
+		log.Err(saveErr).
+			Str("pipeline", pb.Pipeline).
+			Int("buildNumber", pb.BuildNumber).
+			Msg("Failed to save recovered build")
+	}
+	return pb, nil
+}
+
+// errUnknownBuild is a build which was not created for a Gerrit patch set
+var errUnknownBuild = errors.New("unknown build")
+
+// saveBuildState records the state of a webhook build in the backend
+func saveBuildState(ctx context.Context, b backend.Backend, webhook BuildkiteWebhook) {
+	if err := b.SaveBuildState(ctx, webhook.Pipeline.Slug, webhook.Build.Number, webhook.Build.State); err != nil {
+		log.Err(err).
+			Str("webhookEvent", webhook.Event).
+			Str("pipeline", webhook.Pipeline.Slug).
+			Int("webhookBuildNumber", webhook.Build.Number).
+			Str("webhookBuildState", webhook.Build.State).
+			Msg("Failed to save build state")
+	}
 }
 
-func HandleWebhookEvents(events chan BuildkiteWebhook, r GerritReviewWriter, b backend.Backend) {
+// HandleWebhookEvents handles webhooks until events is closed. A webhook which fails,
+// even with a panic, is logged and counted without stopping the webhooks after it.
+func HandleWebhookEvents(events chan BuildkiteWebhook, r GerritReviewWriter, p BuildPipeline, b backend.Backend) {
 	for webhook := range events {
-		log.Debug().Str("event", webhook.Event).Msg("Handling webhook event dispatch")
-		switch webhook.Event {
-		case "build.running":
-			log.Info().Str("event", webhook.Event).Msg("Build running")
-			ctx := context.TODO()
-			pb, err := b.GetBuild(ctx, webhook.Build.Number)
-			if err != nil {
-				log.Err(err).Msg("Failed to get build")
-				return
-			}
-			if err := r.SetReviewState(&Review{
-				Patch:   pb.Patch,
-				Message: fmt.Sprintf("Build %d is running", pb.BuildNumber),
-				State:   ReviewStateUnverified,
-			}); err != nil {
-				log.Err(err).
-					Str("webhookEvent", webhook.Event).
-					Int("buildNumber", pb.BuildNumber).
-					Int("patch", pb.Patch.Number).
-					Int("change", pb.Patch.Change).
-					Int("webhookBuildNumber", webhook.Build.Number).
-					Str("webhookBuildState", webhook.Build.State).
-					Msg("Failed to set review state")
-			}
+		err := handleWebhookEventRecovered(webhook, r, p, b)
+		metricWebhooksHandled.WithLabelValues(webhook.Event, webhookResultLabel(err)).Inc()
+		switch {
+		case errors.Is(err, errUnknownBuild):
+			log.Info().
+				Str("webhookEvent", webhook.Event).
+				Str("pipeline", webhook.Pipeline.Slug).
+				Int("webhookBuildNumber", webhook.Build.Number).
+				Msg("Ignoring webhook of a build not created by the bridge")
+		case err != nil:
+			log.Err(err).
+				Str("webhookEvent", webhook.Event).
+				Str("pipeline", webhook.Pipeline.Slug).
+				Int("webhookBuildNumber", webhook.Build.Number).
+				Msg("Failed to handle webhook")
+		}
+	}
+	log.Info().Msg("Webhook events closed")
+}
 
-		case "build.finished":
-			log.Info().Str("event", webhook.Event).Msg("Build finished")
-			ctx := context.TODO()
-			pb, err := b.GetBuild(ctx, webhook.Build.Number)
-			if err != nil {
-				log.Err(err).Msg("Failed to get build")
-				return
-			}
-			patchMessage := fmt.Sprintf("for Change %d Patch %d", pb.Patch.Change, pb.Patch.Number)
+// webhookResultLabel is the result label of a handled webhook
+func webhookResultLabel(err error) string {
+	if errors.Is(err, errUnknownBuild) {
+		return "unknown_build"
+	}
+	return resultLabel(err)
+}
+
+// handleWebhookEventRecovered handles a webhook and turns a panic into an error
+func handleWebhookEventRecovered(webhook BuildkiteWebhook, r GerritReviewWriter, p BuildPipeline, b backend.Backend) (err error) {
+	ctx, span := startWebhookSpan(webhook)
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+		endSpan(span, err)
+	}()
+	return handleWebhookEvent(ctx, webhook, r, p, b)
+}
+
+// setCurrentReviewState posts a review of a build, applying the stale result policy
+// when a newer patch set superseded the patch set of the build
+func setCurrentReviewState(ctx context.Context, r GerritReviewWriter, b backend.Backend, pb *backend.PatchBuild, review *Review) error {
+	if current, stale := supersedingPatchSet(ctx, r, b, pb); stale && !reportStaleResult(review, current) {
+		return nil
+	}
+	return setReviewState(ctx, r, review)
+}
 
-			message := fmt.Sprintf("[Build %d Passed](%s) %s", pb.BuildNumber, webhook.Build.WebURL, patchMessage)
-			reviewState := ReviewStateVerified
-			if webhook.Build.State == "failed" {
-				message = fmt.Sprintf("[Build %d Failed](%s) %s", pb.BuildNumber, webhook.Build.WebURL, patchMessage)
-				reviewState = ReviewStateRejected
+// handleWebhookEvent reports the state of a webhook build on its patch set
+func handleWebhookEvent(ctx context.Context, webhook BuildkiteWebhook, r GerritReviewWriter, p BuildPipeline, b backend.Backend) error {
+	log.Debug().Str("event", webhook.Event).Msg("Handling webhook event dispatch")
+	switch webhook.Event {
+	case "build.running":
+		log.Info().Str("event", webhook.Event).Msg("Build running")
+		pb, err := lookupPatchBuild(ctx, p, b, webhook)
+		if err != nil {
+			return err
+		}
+		saveBuildState(ctx, b, webhook)
+		return forEachTopicPatch(webhook.Build, pb, func(pb *backend.PatchBuild) error {
+			review := &Review{
+				Patch:    pb.Patch,
+				Message:  reviewMessage(webhook.Event, webhook.Build, pb),
+				State:    ReviewStateUnverified,
+				OmitVote: pb.Trigger == backend.TriggerPostMerge,
 			}
-			if err := r.SetReviewState(&Review{
+			setNotify(ctx, b, webhook, pb, review)
+			return setCurrentReviewState(ctx, r, b, pb, review)
+		})
+
+	case "build.finished":
+		log.Info().Str("event", webhook.Event).Msg("Build finished")
+		pb, err := lookupPatchBuild(ctx, p, b, webhook)
+		if err != nil {
+			return err
+		}
+		saveBuildState(ctx, b, webhook)
+		outcome := buildOutcome(webhook.Build)
+		defer queuePassedChildBuilds(ctx, webhook, p, b, pb)
+		return forEachTopicPatch(webhook.Build, pb, func(pb *backend.PatchBuild) error {
+			review := &Review{
 				Patch:   pb.Patch,
-				Message: message,
-				State:   reviewState,
-			}); err != nil {
-				log.Err(err).
-					Str("webhookEvent", webhook.Event).
-					Int("buildNumber", pb.BuildNumber).
-					Int("patch", pb.Patch.Number).
-					Int("change", pb.Patch.Change).
-					Int("webhookBuildNumber", webhook.Build.Number).
-					Str("webhookBuildState", webhook.Build.State).
-					Msg("Failed to set review state")
+				Message: reviewMessage(webhook.Event, webhook.Build, pb),
+				State:   outcome.Vote,
+				// The merged change already has its votes
+				OmitVote: outcome.OmitVote || pb.Trigger == backend.TriggerPostMerge,
 			}
-			// TODO: Notify Gerrit of build finished
-		case "build.scheduled":
-			log.Info().Str("event", webhook.Event).Msg("Build scheduled")
-		case "build.cancelled":
-			log.Info().Str("event", webhook.Event).Msg("Build cancelled")
-			ctx := context.TODO()
-			pb, err := b.GetBuild(ctx, webhook.Build.Number)
-			if err != nil {
-				log.Err(err).Msg("Failed to get build")
-				return
+			setNotify(ctx, b, webhook, pb, review)
+			setAttention(ctx, r, b, webhook.Build, pb, review)
+			if err := setCurrentReviewState(ctx, r, b, pb, review); err != nil {
+				return err
 			}
-			log.Info().
-				Int("change", pb.Patch.Change).
-				Int("patch", pb.Patch.Number).
-				Int("buildNumber", pb.BuildNumber).
-				Msg("Cancelled build")
-
-		default:
-			log.Warn().Str("event", webhook.Event).Msg("Unknown event")
+			if err := recordAttention(ctx, b, review); err != nil {
+				log.Err(err).
+					Int("change", pb.Change).
+					Msg("Failed to save the attention set added by the bridge")
+			}
+			return nil
+		})
+	case "build.scheduled":
+		log.Info().Str("event", webhook.Event).Msg("Build scheduled")
+	case "build.cancelled":
+		log.Info().Str("event", webhook.Event).Msg("Build cancelled")
+		pb, err := lookupPatchBuild(ctx, p, b, webhook)
+		if err != nil {
+			return err
 		}
+		saveBuildState(ctx, b, webhook)
+		log.Info().
+			Int("change", pb.Patch.Change).
+			Int("patch", pb.Patch.Number).
+			Int("buildNumber", pb.BuildNumber).
+			Msg("Cancelled build")
+
+	default:
+		log.Warn().Str("event", webhook.Event).Msg("Unknown event")
 	}
+	return nil
 }
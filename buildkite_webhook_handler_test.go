@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func TestItRecoversBuildsFromWebhookMetaData(t *testing.T) {
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	b.MockGetBuild = func(ctx context.Context, pipeline string, buildNumber int) (*backend.PatchBuild, error) {
+		return nil, backend.ErrBuildNotFound
+	}
+	var saved *backend.PatchBuild
+	b.MockSaveBuild = func(ctx context.Context, pb *backend.PatchBuild) error {
+		saved = pb
+		return nil
+	}
+	webhook := BuildkiteWebhook{
+		Event:    "build.finished",
+		Pipeline: BuildkitePipeline{Slug: "mock-pipeline"},
+		Build: Build{
+			Number:   7,
+			State:    "passed",
+			MetaData: map[string]string{"gerrit_change": "42", "gerrit_patchset": "3"},
+		},
+	}
+	pb, err := lookupPatchBuild(context.Background(), p, b, webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pb.Change != 42 || pb.Number != 3 || pb.BuildNumber != 7 {
+		t.Errorf("Unexpected patch build %+v", pb)
+	}
+	if saved != pb {
+		t.Error("Expected the recovered build to be saved")
+	}
+	if p.FunctionCallCounter["GetBuild"] != 0 {
+		t.Error("Expected the build not to be fetched when the webhook has its meta-data")
+	}
+}
+
+func TestItRecoversBuildsFromBuildkite(t *testing.T) {
+	p := NewMockPipeline()
+	p.MockGetBuild = func(buildNumber int) (*Build, error) {
+		return &Build{
+			Number: buildNumber,
+			State:  "failed",
+			Env:    map[string]any{"GERRIT_CHANGE_NUMBER": "42", "GERRIT_PATCHSET_NUMBER": 3},
+		}, nil
+	}
+	b := NewMockBackend()
+	b.MockGetBuild = func(ctx context.Context, pipeline string, buildNumber int) (*backend.PatchBuild, error) {
+		return nil, backend.ErrBuildNotFound
+	}
+	webhook := BuildkiteWebhook{Pipeline: BuildkitePipeline{Slug: "mock-pipeline"}, Build: Build{Number: 7}}
+
+	pb, err := lookupPatchBuild(context.Background(), p, b, webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pb.Change != 42 || pb.Number != 3 {
+		t.Errorf("Unexpected patch build %+v", pb)
+	}
+
+	// Builds which were not created for a patch set stay unknown
+	p.MockGetBuild = func(buildNumber int) (*Build, error) {
+		return &Build{Number: buildNumber}, nil
+	}
+	if _, err := lookupPatchBuild(context.Background(), p, b, webhook); !errors.Is(err, errUnknownBuild) {
+		t.Errorf("Expected an unknown build error, but got %v", err)
+	}
+}
+
+func TestItIgnoresBuildsOfUnregisteredPipelines(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	b.MockGetBuild = func(ctx context.Context, pipeline string, buildNumber int) (*backend.PatchBuild, error) {
+		return nil, backend.ErrBuildNotFound
+	}
+	webhook := BuildkiteWebhook{Pipeline: BuildkitePipeline{Slug: "other-project"}, Build: Build{Number: 7}}
+
+	if _, err := lookupPatchBuild(context.Background(), p, b, webhook); !errors.Is(err, errUnknownBuild) {
+		t.Errorf("Expected an unknown build error, but got %v", err)
+	}
+	if p.FunctionCallCounter["GetBuild"] != 0 || b.FunctionCallCounter["SaveBuild"] != 0 {
+		t.Error("Expected the build not to be fetched from the default pipeline or saved")
+	}
+}
+
+func TestItKeepsHandlingWebhooksAfterAFailure(t *testing.T) {
+	p := NewMockPipeline()
+	// Buildkite knows build 1 but it was not created by the bridge
+	p.MockGetBuild = func(buildNumber int) (*Build, error) {
+		return &Build{Number: buildNumber, State: "passed"}, nil
+	}
+	b := NewMockBackend()
+	b.MockGetBuild = func(ctx context.Context, pipeline string, buildNumber int) (*backend.PatchBuild, error) {
+		if buildNumber == 3 {
+			return &backend.PatchBuild{BuildNumber: 3, Pipeline: pipeline, Patch: &backend.Patch{Number: 1, Change: 42}}, nil
+		}
+		return nil, backend.ErrBuildNotFound
+	}
+	gerrit := NewMockGerrit()
+	reviewed := []int{}
+	gerrit.MockSetReviewState = func(r *Review) error {
+		if r.Change == 0 {
+			panic("review without a change")
+		}
+		reviewed = append(reviewed, r.Change)
+		return nil
+	}
+	b.MockSaveBuild = func(ctx context.Context, pb *backend.PatchBuild) error {
+		return errors.New("redis is down")
+	}
+
+	events := make(chan BuildkiteWebhook, 3)
+	pipeline := BuildkitePipeline{Slug: "mock-pipeline"}
+	events <- BuildkiteWebhook{Event: "build.finished", Pipeline: pipeline, Build: Build{Number: 1, State: "passed"}}
+	// Build 2 has meta-data without a change and panics when reported
+	events <- BuildkiteWebhook{Event: "build.finished", Pipeline: pipeline, Build: Build{Number: 2, State: "passed", MetaData: map[string]string{"gerrit_change": "0", "gerrit_patchset": "1"}}}
+	events <- BuildkiteWebhook{Event: "build.finished", Pipeline: pipeline, Build: Build{Number: 3, State: "passed"}}
+	close(events)
+
+	HandleWebhookEvents(events, gerrit, p, b)
+	if len(reviewed) != 1 || reviewed[0] != 42 {
+		t.Errorf("Expected only change 42 to be reviewed, but reviewed %v", reviewed)
+	}
+}
+
+func TestItRejectsWebhooksWhenTheQueueIsFull(t *testing.T) {
+	events := make(chan BuildkiteWebhook, 1)
+	h := &BuildkiteWebhookHandler{token: "secret", HookEvents: events}
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"event":"build.running","build":{"number":1}}`))
+		req.Header.Set("X-Buildkite-Token", "secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := post(); code != http.StatusOK {
+		t.Errorf("Expected the first webhook to be queued, but got %d", code)
+	}
+	if code := post(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a full queue to return 503, but got %d", code)
+	}
+}
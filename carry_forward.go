@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// CarryForwardConfig configures which patch set kinds reuse the build of the previous patch set
+//
+//	carry_forward:
+//	  kinds: [TRIVIAL_REBASE, NO_CODE_CHANGE, NO_CHANGE]
+//	  projects:
+//	    my-project: [NO_CHANGE]
+//	  states: [passed, failed]
+type CarryForwardConfig struct {
+	// Kinds of patch sets which carry the previous result forward in every project. Other kinds are built
+	Kinds []string `yaml:"kinds"`
+	// Projects replace Kinds for a project. An empty list builds every patch set of the project
+	Projects map[string][]string `yaml:"projects"`
+	// States of the previous build which are carried forward. Empty carries passed builds. Other states are built
+	States []string `yaml:"states"`
+}
+
+// patchSetKinds are the kinds of patch sets written by Gerrit which can carry a result forward
+var patchSetKinds = []string{"TRIVIAL_REBASE", "NO_CODE_CHANGE", "NO_CHANGE", "MERGE_FIRST_PARENT_UPDATE"}
+
+// carriedStates are the build states which can be carried forward
+var carriedStates = []string{"passed", "failed"}
+
+// CarriesForward checks a patch set kind of a project reuses the build of the previous patch set
+func (c CarryForwardConfig) CarriesForward(project, kind string) bool {
+	kinds, ok := c.Projects[project]
+	if !ok {
+		kinds = c.Kinds
+	}
+	return slices.Contains(kinds, kind)
+}
+
+// CarriesState checks the result of a previous build in a state is carried forward
+func (c CarryForwardConfig) CarriesState(state string) bool {
+	if len(c.States) == 0 {
+		return state == "passed"
+	}
+	return slices.Contains(c.States, state)
+}
+
+// Validate checks the configured kinds are written by Gerrit
+func (c CarryForwardConfig) Validate() error {
+	check := func(kinds []string) error {
+		for _, kind := range kinds {
+			if !slices.Contains(patchSetKinds, kind) {
+				return fmt.Errorf("carry_forward kind %q must be one of %v", kind, patchSetKinds)
+			}
+		}
+		return nil
+	}
+	if err := check(c.Kinds); err != nil {
+		return err
+	}
+	for _, kinds := range c.Projects {
+		if err := check(kinds); err != nil {
+			return err
+		}
+	}
+	for _, state := range c.States {
+		if !slices.Contains(carriedStates, state) {
+			return fmt.Errorf("carry_forward state %q must be one of %v", state, carriedStates)
+		}
+	}
+	return nil
+}
+
+// carryForwardBuild reports the build of the previous patch set on the patch set of an event instead of building it.
+// It returns false when there is no previous build, or its state is not carried forward, so the patch set is built.
+func carryForwardBuild(event Event, b backend.Backend) (bool, error) {
+	if event.PatchSet.Number < 2 || !config.CarryForward.CarriesForward(event.Change.Project, event.PatchSet.Kind) {
+		return false, nil
+	}
+	prev, err := b.GetPatch(event.Context(), &backend.Patch{
+		Number: event.PatchSet.Number - 1,
+		Change: event.Change.Number,
+	})
+	if err != nil || prev == nil {
+		log.Debug().
+			Err(err).
+			Int("change", event.Change.Number).
+			Int("patch", event.PatchSet.Number).
+			Msg("No previous build to carry forward")
+		return false, nil
+	}
+	if !config.CarryForward.CarriesState(prev.State) {
+		log.Debug().
+			Int("change", event.Change.Number).
+			Int("patch", event.PatchSet.Number).
+			Int("buildNumber", prev.BuildNumber).
+			Str("state", prev.State).
+			Msg("Previous build state is not carried forward")
+		return false, nil
+	}
+	log.Info().
+		Str("eventType", event.Type).
+		Int("change", event.Change.Number).
+		Int("patch", event.PatchSet.Number).
+		Str("kind", event.PatchSet.Kind).
+		Int("buildNumber", prev.BuildNumber).
+		Str("state", prev.State).
+		Msg("Carrying build forward")
+
+	// The new patch set reuses the result, the build still belongs to the previous patch set
+	patch := &backend.Patch{
+		Number:   event.PatchSet.Number,
+		Change:   event.Change.Number,
+		Revision: event.PatchSet.Revision,
+	}
+	if err := b.SaveCarriedBuild(event.Context(), patch, prev); err != nil {
+		return false, err
+	}
+
+	outcome := buildOutcome(Build{State: prev.State})
+	review := &Review{
+		Patch:    patch,
+		Message:  carriedMessage(prev, event.PatchSet.Kind),
+		State:    outcome.Vote,
+		OmitVote: outcome.OmitVote,
+	}
+	return true, setReviewState(event.Context(), gerritClient, review)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func TestCarriesForward(t *testing.T) {
+	c := CarryForwardConfig{
+		Kinds:    []string{"TRIVIAL_REBASE", "NO_CODE_CHANGE"},
+		Projects: map[string][]string{"strict": {}},
+	}
+	if !c.CarriesForward("any", "TRIVIAL_REBASE") {
+		t.Error("Expected a trivial rebase to carry forward")
+	}
+	if c.CarriesForward("any", "REWORK") {
+		t.Error("Expected a rework not to carry forward")
+	}
+	if c.CarriesForward("strict", "TRIVIAL_REBASE") {
+		t.Error("Expected the project policy to replace the default kinds")
+	}
+	if err := (CarryForwardConfig{Kinds: []string{"TRIVIAL"}}).Validate(); err == nil {
+		t.Error("Expected an unknown kind to be rejected")
+	}
+}
+
+func TestItCarriesThePreviousResultForward(t *testing.T) {
+	c := defaultConfig()
+	c.CarryForward.Kinds = []string{"TRIVIAL_REBASE"}
+	withConfig(t, c, map[string]BuildPipeline{})
+	gerrit := NewMockGerrit()
+	var review *Review
+	gerrit.MockSetReviewState = func(r *Review) error {
+		review = r
+		return nil
+	}
+	withGerrit(t, gerrit)
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	b.MockGetPatch = func(ctx context.Context, patch *backend.Patch) (*backend.PatchBuild, error) {
+		return &backend.PatchBuild{BuildNumber: 12, Pipeline: p.Slug(), State: "passed", Patch: patch}, nil
+	}
+	var carried *backend.Patch
+	b.MockSaveCarriedBuild = func(ctx context.Context, patch *backend.Patch, pb *backend.PatchBuild) error {
+		if pb.BuildNumber == 12 {
+			carried = patch
+		}
+		return nil
+	}
+
+	event := Event{
+		Type:     "patchset-created",
+		PatchSet: PatchSet{Number: 3, Kind: "TRIVIAL_REBASE"},
+		Change:   Change{Number: 42},
+	}
+	if err := HandlePatchsetCreated(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 0 || p.FunctionCallCounter["CancelBuild"] != 0 {
+		t.Errorf("Expected no builds to be created or cancelled, but got %v", p.FunctionCallCounter)
+	}
+	if carried == nil || carried.Number != 3 {
+		t.Errorf("Expected build 12 to be carried to patch set 3, but got %+v", carried)
+	}
+	if b.FunctionCallCounter["SaveBuild"] != 0 {
+		t.Error("Expected the build to keep belonging to patch set 2")
+	}
+	if review == nil || review.State != ReviewStateVerified || !strings.Contains(review.Message, "carried from PS2, build 12") {
+		t.Errorf("Expected the passed result to be carried forward, but got %+v", review)
+	}
+
+	// Other kinds are built
+	event.PatchSet.Kind = "REWORK"
+	HandlePatchsetCreated(event, p, b)
+	if p.FunctionCallCounter["CreateBuild"] != 1 {
+		t.Errorf("Expected CreateBuild to be called once, but it was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+
+	// Unfinished, canceled and failed builds are built
+	event.PatchSet.Kind = "TRIVIAL_REBASE"
+	for _, state := range []string{"running", "canceled", "skipped", "not_run", "failed"} {
+		b.MockGetPatch = func(ctx context.Context, patch *backend.Patch) (*backend.PatchBuild, error) {
+			return &backend.PatchBuild{BuildNumber: 12, Pipeline: p.Slug(), State: state, Patch: patch}, nil
+		}
+		p.Reset("CreateBuild")
+		HandlePatchsetCreated(event, p, b)
+		if p.FunctionCallCounter["CreateBuild"] != 1 {
+			t.Errorf("Expected a %s build not to be carried forward", state)
+		}
+	}
+
+	// Failed builds are carried forward when configured
+	c.CarryForward.States = []string{"passed", "failed"}
+	p.Reset("CreateBuild")
+	HandlePatchsetCreated(event, p, b)
+	if p.FunctionCallCounter["CreateBuild"] != 0 || review.State != ReviewStateRejected {
+		t.Errorf("Expected the failed result to be carried forward, but got %+v", review)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// buildFinished checks a Buildkite build state is final
+func buildFinished(state string) bool {
+	switch state {
+	case "passed", "failed", "canceled", "skipped", "not_run", "finished":
+		return true
+	}
+	return false
+}
+
+// cancelChangeBuilds cancels every unfinished build of the change of an event
+func cancelChangeBuilds(event Event, p BuildPipeline, b backend.Backend) error {
+	return cancelBuildsBefore(event, p, b, 0)
+}
+
+// cancelSupersededBuilds cancels the unfinished builds of earlier patch sets of the change of an event
+func cancelSupersededBuilds(event Event, p BuildPipeline, b backend.Backend) error {
+	return cancelBuildsBefore(event, p, b, event.PatchSet.Number)
+}
+
+// cancelBuildsBefore cancels the unfinished builds of the change of an event with a patch set number before patch.
+// Zero cancels the builds of every patch set. Topic builds are kept as the other changes of the topic share them.
+// The state of each build is checked with Buildkite first as the backend only knows the state of the last webhook received.
+func cancelBuildsBefore(event Event, p BuildPipeline, b backend.Backend, patch int) error {
+	builds, err := b.GetChangeBuilds(event.Context(), event.Change.Number)
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, pb := range builds {
+		if buildFinished(pb.State) || (patch > 0 && pb.Patch.Number >= patch) {
+			continue
+		}
+		if pb.Trigger == backend.TriggerTopic {
+			log.Info().
+				Str("eventType", event.Type).
+				Int("change", event.Change.Number).
+				Int("buildNumber", pb.BuildNumber).
+				Str("topic", event.Change.Topic).
+				Msg("Keeping topic build shared with other changes")
+			continue
+		}
+		pipeline := pipelineBySlug(pb.Pipeline, p)
+		if build, err := pipeline.GetBuild(pb.BuildNumber); err != nil {
+			log.Warn().
+				Err(err).
+				Int("change", event.Change.Number).
+				Int("buildNumber", pb.BuildNumber).
+				Msg("Failed to get build state, cancelling anyway")
+		} else if buildFinished(build.State) {
+			if err := b.SaveBuildState(event.Context(), pb.Pipeline, pb.BuildNumber, build.State); err != nil {
+				log.Err(err).Int("buildNumber", pb.BuildNumber).Msg("Failed to save build state")
+			}
+			continue
+		}
+		log.Info().
+			Str("eventType", event.Type).
+			Int("change", event.Change.Number).
+			Int("patch", pb.Patch.Number).
+			Int("buildNumber", pb.BuildNumber).
+			Str("pipeline", pb.Pipeline).
+			Msg("Cancelling build of change")
+		result, err := pipeline.CancelBuild(pb.BuildNumber)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Int("change", event.Change.Number).
+				Int("buildNumber", pb.BuildNumber).
+				Msg("Failed to cancel build")
+			errs = append(errs, err)
+			continue
+		}
+		if result != CancelResultCancelled {
+			log.Info().
+				Int("change", event.Change.Number).
+				Int("buildNumber", pb.BuildNumber).
+				Stringer("result", result).
+				Msg("Build was not cancelled")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// HandleChangeClosed cancels the builds of an abandoned or deleted change
+func HandleChangeClosed(event Event, p BuildPipeline, b backend.Backend) error {
+	return cancelChangeBuilds(event, p, b)
+}
+
+// HandleChangeRestored builds the current patch set of a restored change
+func HandleChangeRestored(event Event, p BuildPipeline, b backend.Backend) error {
+	log.Info().
+		Str("eventType", event.Type).
+		Int("change", event.Change.Number).
+		Int("patch", event.PatchSet.Number).
+		Msg("Building restored change")
+	return createChangeBuild(event, p, b)
+}
+
+// HandleWipStateChanged cancels the builds of a change marked work in progress
+// and builds its current patch set when it is ready for review
+func HandleWipStateChanged(event Event, p BuildPipeline, b backend.Backend) error {
+	if event.Change.Wip {
+		return cancelChangeBuilds(event, p, b)
+	}
+	log.Info().
+		Str("eventType", event.Type).
+		Int("change", event.Change.Number).
+		Int("patch", event.PatchSet.Number).
+		Msg("Building change ready for review")
+	return createChangeBuild(event, p, b)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func TestItCancelsUnfinishedBuildsOfAClosedChange(t *testing.T) {
+	p := NewMockPipeline()
+	cancelled := []int{}
+	p.MockCancelBuild = func(buildNumber int) (CancelResult, error) {
+		cancelled = append(cancelled, buildNumber)
+		return CancelResultCancelled, nil
+	}
+	b := NewMockBackend()
+	b.MockGetChangeBuilds = func(ctx context.Context, change int) ([]*backend.PatchBuild, error) {
+		return []*backend.PatchBuild{
+			{BuildNumber: 1, Pipeline: p.Slug(), State: "passed", Patch: &backend.Patch{Number: 1, Change: change}},
+			{BuildNumber: 2, Pipeline: p.Slug(), State: "running", Patch: &backend.Patch{Number: 2, Change: change}},
+			{BuildNumber: 3, Pipeline: p.Slug(), State: "scheduled", Patch: &backend.Patch{Number: 2, Change: change}},
+			{BuildNumber: 4, Pipeline: p.Slug(), State: "running", Trigger: backend.TriggerTopic, Patch: &backend.Patch{Number: 2, Change: change}},
+		}, nil
+	}
+
+	for _, event := range []Event{
+		{Type: "change-abandoned", Change: Change{Number: 42}},
+		{Type: "change-deleted", Change: Change{Number: 42}},
+		{Type: "wip-state-changed", Change: Change{Number: 42, Wip: true}},
+	} {
+		cancelled = []int{}
+		var err error
+		if event.Type == "wip-state-changed" {
+			err = HandleWipStateChanged(event, p, b)
+		} else {
+			err = HandleChangeClosed(event, p, b)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cancelled) != 2 || cancelled[0] != 2 || cancelled[1] != 3 {
+			t.Errorf("Expected %s to cancel builds 2 and 3, but cancelled %v", event.Type, cancelled)
+		}
+	}
+}
+
+func TestItBuildsRestoredAndReadyChanges(t *testing.T) {
+	p := NewMockPipeline()
+	b := NewMockBackend()
+
+	HandleChangeRestored(Event{Type: "change-restored", Change: Change{Number: 42}, PatchSet: PatchSet{Number: 2}}, p, b)
+	HandleWipStateChanged(Event{Type: "wip-state-changed", Change: Change{Number: 42}, PatchSet: PatchSet{Number: 2}}, p, b)
+	if p.FunctionCallCounter["CreateBuild"] != 2 {
+		t.Errorf("Expected CreateBuild to be called twice, but it was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+	if p.FunctionCallCounter["CancelBuild"] != 0 {
+		t.Errorf("Expected no builds to be cancelled, but CancelBuild was called %d times", p.FunctionCallCounter["CancelBuild"])
+	}
+}
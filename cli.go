@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+// cliCommand is an operator subcommand run instead of the daemon
+// Ex: gerrit-event-handler --buildkite-org-slug my-org trigger 12,3
+type cliCommand struct {
+	Usage       string
+	Description string
+	Run         func(args []string) error
+}
+
+var cliCommands = map[string]cliCommand{
+	"trigger": {
+		Usage:       "trigger <change>,<patch>",
+		Description: "Create a build of a patch set",
+		Run:         runTriggerCommand,
+	},
+	"cancel": {
+		Usage:       "cancel [--pipeline S] <build>",
+		Description: "Cancel a build",
+		Run:         runCancelCommand,
+	},
+	"lookup": {
+		Usage:       "lookup --build N [--pipeline S] | --change C [--patch P]",
+		Description: "Print the builds saved in the backend for a build, patch set or change",
+		Run:         runLookupCommand,
+	},
+	"replay": {
+		Usage:       "replay <file>",
+		Description: "Dispatch the Gerrit events in a file of JSON lines to the enabled handlers",
+		Run:         runReplayCommand,
+	},
+	"validate-config": {
+		Usage:       "validate-config",
+		Description: "Check the flags, config file, credential files and connectivity to Redis and Buildkite",
+		Run:         runValidateConfigCommand,
+	},
+	"post-review": {
+		Usage:       "post-review --change C --patch P [--state N] --message M",
+		Description: "Post a review to a patch set. Ex: to report a build which was never reported",
+		Run:         runPostReviewCommand,
+	},
+}
+
+// errUsage is returned by a command when its arguments are invalid
+var errUsage = errors.New("invalid arguments")
+
+// runCommand runs the subcommand named by args[0]
+func runCommand(args []string) error {
+	command, ok := cliCommands[args[0]]
+	if !ok {
+		printCommandUsage()
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	if err := command.Run(args[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			return fmt.Errorf("usage: %s", command.Usage)
+		}
+		return err
+	}
+	return nil
+}
+
+func printCommandUsage() {
+	names := make([]string, 0, len(cliCommands))
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-60s %s\n", cliCommands[name].Usage, cliCommands[name].Description)
+	}
+}
+
+// printJSON writes v to stdout for use in scripts
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// parseChangePatch parses a Gerrit style change,patch pair. Ex: 12,3
+func parseChangePatch(s string) (int, int, error) {
+	changeSlug, patchSlug, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected <change>,<patch> but got %q", s)
+	}
+	change, err := strconv.Atoi(changeSlug)
+	if err != nil {
+		return 0, 0, fmt.Errorf("change must be a number: %q", changeSlug)
+	}
+	patch, err := strconv.Atoi(patchSlug)
+	if err != nil {
+		return 0, 0, fmt.Errorf("patch must be a number: %q", patchSlug)
+	}
+	return change, patch, nil
+}
+
+func runTriggerCommand(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	change, patch, err := parseChangePatch(args[0])
+	if err != nil {
+		return err
+	}
+	client, err := NewGerritSSHClient(*flagGerritSshUrl, *flagGerritSshKeyPath)
+	if err != nil {
+		return err
+	}
+	pipeline, err := newPipeline()
+	if err != nil {
+		return err
+	}
+	if err := setupConfig(pipeline, client); err != nil {
+		return err
+	}
+	gerritClient = client
+	event, err := queryPatchSetEvent(client, "cli-trigger", change, patch)
+	if err != nil {
+		return err
+	}
+	if err := createChangeBuild(event, pipeline, backend.NewRedisBackend(*flagBuildkitePipelineSlug)); err != nil {
+		return err
+	}
+	return printJSON(&backend.Patch{
+		Number:   event.PatchSet.Number,
+		Change:   event.Change.Number,
+		Revision: event.PatchSet.Revision,
+	})
+}
+
+func runCancelCommand(args []string) error {
+	flags := flag.NewFlagSet("cancel", flag.ContinueOnError)
+	pipelineSlug := flags.String("pipeline", *flagBuildkitePipelineSlug, "Buildkite pipeline slug of the build")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	buildNumber, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("build must be a number: %q", flags.Arg(0))
+	}
+	pipeline, err := newPipeline()
+	if err != nil {
+		return err
+	}
+	result, err := pipeline.WithSlug(*pipelineSlug).CancelBuild(buildNumber)
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]any{"buildNumber": buildNumber, "result": result})
+}
+
+func runLookupCommand(args []string) error {
+	flags := flag.NewFlagSet("lookup", flag.ContinueOnError)
+	buildNumber := flags.Int("build", 0, "Build number")
+	pipelineSlug := flags.String("pipeline", *flagBuildkitePipelineSlug, "Buildkite pipeline slug of --build")
+	change := flags.Int("change", 0, "Change number")
+	patch := flags.Int("patch", 0, "Patch set number. Requires --change")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	b := backend.NewRedisBackend(*flagBuildkitePipelineSlug)
+	switch {
+	case *buildNumber > 0:
+		pb, err := b.GetBuild(ctx, *pipelineSlug, *buildNumber)
+		if err != nil {
+			return err
+		}
+		return printJSON(pb)
+	case *change > 0 && *patch > 0:
+		pb, err := b.GetPatch(ctx, &backend.Patch{Number: *patch, Change: *change})
+		if err != nil {
+			return err
+		}
+		return printJSON(pb)
+	case *change > 0:
+		builds, err := b.GetChangeBuilds(ctx, *change)
+		if err != nil {
+			return err
+		}
+		return printJSON(builds)
+	}
+	return errUsage
+}
+
+func runReplayCommand(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	fh, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	client, err := NewGerritSSHClient(*flagGerritSshUrl, *flagGerritSshKeyPath)
+	if err != nil {
+		return err
+	}
+	pipeline, err := newPipeline()
+	if err != nil {
+		return err
+	}
+	if err := setupConfig(pipeline, client); err != nil {
+		return err
+	}
+	gerritClient = client
+	b := backend.NewRedisBackend(*flagBuildkitePipelineSlug)
+	registerEventHandlers(client)
+
+	scanner := bufio.NewScanner(fh)
+	maxBufferSize := 1024 * 1024
+	scanner.Buffer(make([]byte, maxBufferSize), maxBufferSize)
+	failed := 0
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		event := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		event = recentEvents.Add(event)
+		for _, handler := range eventRouter[event.Type] {
+			if err := handler(event, pipeline, b); err != nil {
+				failed++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := printJSON(recentEvents.Recent()); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d handlers failed", failed)
+	}
+	return nil
+}
+
+// validateConfig checks the configuration and reports each check by name
+func validateConfig(ctx context.Context) map[string]error {
+	checks := map[string]error{}
+	checkFile := func(name, path string) {
+		_, err := readToken(path)
+		checks[name] = err
+	}
+
+	if u, err := url.Parse(*flagGerritSshUrl); err != nil {
+		checks["gerrit-ssh-url"] = err
+	} else if u.User == nil || u.Hostname() == "" {
+		checks["gerrit-ssh-url"] = fmt.Errorf("expected ssh://user@host:port/project but got %s", *flagGerritSshUrl)
+	} else {
+		checks["gerrit-ssh-url"] = nil
+	}
+	checkFile("gerrit-ssh-key-path", *flagGerritSshKeyPath)
+
+	if *flagEnableBuildkiteIntegration || !*flagBuildkiteWebhookHandlerDisabled {
+		pipeline, err := newPipeline()
+		checks["buildkite-api"] = err
+		if err == nil {
+			ctx, cancel := context.WithTimeout(ctx, *flagHealthCheckTimeout)
+			checks["buildkite-api"] = pipeline.Ping(ctx)
+			cancel()
+		}
+	}
+	if *flagConfigPath != "" {
+		_, err := loadConfig(*flagConfigPath)
+		checks["config-path"] = err
+	}
+	if *flagEnableChangeReplication {
+		_, err := url.Parse(*flagReplicationDestinationUrl)
+		checks["replication-destination-url"] = err
+		checkFile("replication-ssh-key-path", *flagReplicationSshKeyPath)
+	}
+	if *flagAdminApiPort != "" {
+		checkFile("admin-api-token-path", *flagAdminApiTokenPath)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *flagHealthCheckTimeout)
+	defer cancel()
+	checks["redis"] = backend.NewRedisBackend(*flagBuildkitePipelineSlug).Ping(ctx)
+	return checks
+}
+
+func runValidateConfigCommand(args []string) error {
+	checks := validateConfig(context.Background())
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failed := []error{}
+	for _, name := range names {
+		if err := checks[name]; err != nil {
+			fmt.Printf("FAIL %s: %s\n", name, err)
+			failed = append(failed, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+	return errors.Join(failed...)
+}
+
+func runPostReviewCommand(args []string) error {
+	flags := flag.NewFlagSet("post-review", flag.ContinueOnError)
+	change := flags.Int("change", 0, "Change number")
+	patch := flags.Int("patch", 0, "Patch set number")
+	state := flags.Int("state", ReviewStateUnverified, "Vote to post. Ex: 1, 0 or -1")
+	message := flags.String("message", "", "Review message")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *change == 0 || *patch == 0 || *message == "" {
+		return errUsage
+	}
+	client, err := NewGerritSSHClient(*flagGerritSshUrl, *flagGerritSshKeyPath)
+	if err != nil {
+		return err
+	}
+	return client.SetReviewState(&Review{
+		Patch:   &backend.Patch{Number: *patch, Change: *change},
+		State:   *state,
+		Message: *message,
+	})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseChangePatch(t *testing.T) {
+	change, patch, err := parseChangePatch("12,3")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if change != 12 || patch != 3 {
+		t.Errorf("Expected change 12 patch 3, but got change %d patch %d", change, patch)
+	}
+	for _, s := range []string{"12", "12,", ",3", "a,3", "12,b"} {
+		if _, _, err := parseChangePatch(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestRunCommandReportsUsage(t *testing.T) {
+	err := runCommand([]string{"trigger"})
+	if err == nil || !strings.Contains(err.Error(), cliCommands["trigger"].Usage) {
+		t.Errorf("Expected the trigger usage, but got %v", err)
+	}
+	if err := runCommand([]string{"unknown"}); err == nil {
+		t.Error("Expected an unknown command to fail")
+	}
+}
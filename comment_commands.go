@@ -0,0 +1,280 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// CommentCommand is a command written on a line of its own in a Gerrit comment.
+// Ex: retest full-ci
+type CommentCommand struct {
+	// Name is the first word of the command line. It is matched case-insensitively
+	Name string
+	// Usage describes the arguments of the command. Ex: retest [pipeline]
+	Usage       string
+	Description string
+	Run         commandFunc
+}
+
+// commandFunc handles a command with the words which followed its name
+type commandFunc func(event Event, args []string, p BuildPipeline, b backend.Backend) error
+
+// commentCommands are checked in the order they are registered. The first one found in a comment runs.
+var commentCommands = []*CommentCommand{}
+
+func init() {
+	registerCommentCommand(&CommentCommand{
+		Name:        "retest",
+		Usage:       "retest [pipeline]",
+		Description: "Build the patch set again, on a named pipeline when given",
+		Run:         handleRetestComment,
+	})
+	registerCommentCommand(&CommentCommand{
+		Name:        "rebuild",
+		Usage:       "rebuild [--clean] [pipeline]",
+		Description: "Build the patch set again, from a clean checkout with --clean",
+		Run:         handleRebuildComment,
+	})
+	registerCommentCommand(&CommentCommand{
+		Name:        "help",
+		Usage:       "help",
+		Description: "List the commands",
+		Run:         handleHelpComment,
+	})
+}
+
+// registerCommentCommand adds a command after those already registered
+func registerCommentCommand(cmd *CommentCommand) {
+	if findCommentCommand(cmd.Name) != nil {
+		log.Fatal().Str("command", cmd.Name).Msg("Comment command registered twice")
+	}
+	commentCommands = append(commentCommands, cmd)
+}
+
+// findCommentCommand returns the command named name or nil
+func findCommentCommand(name string) *CommentCommand {
+	for _, cmd := range commentCommands {
+		if strings.EqualFold(cmd.Name, name) {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// CommandInvocation is a command found in a comment and its arguments
+type CommandInvocation struct {
+	Command *CommentCommand
+	Args    []string
+}
+
+// parseCommandLine splits a line into a command name and arguments when it starts with prefix.
+// Words must be separated by single spaces without leading or trailing whitespace.
+func parseCommandLine(line string, prefix string) (string, []string, bool) {
+	rest, ok := strings.CutPrefix(line, prefix)
+	if !ok || rest == "" {
+		return "", nil, false
+	}
+	words := strings.Fields(rest)
+	if strings.Join(words, " ") != rest {
+		return "", nil, false
+	}
+	return words[0], words[1:], true
+}
+
+// findCommandInvocation returns the first registered command written in a comment after one of prefixes
+func findCommandInvocation(comment string, prefixes []string) (*CommandInvocation, bool) {
+	lines := parseCommentBody(comment)
+	for _, cmd := range commentCommands {
+		for _, line := range lines {
+			for _, prefix := range prefixes {
+				name, args, ok := parseCommandLine(line, prefix)
+				if ok && strings.EqualFold(name, cmd.Name) {
+					return &CommandInvocation{Command: cmd, Args: args}, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// commentIgnored returns why the comment of an event should not run commands.
+// Comments by bots and the bridge itself could otherwise start builds in a loop.
+func commentIgnored(event Event) (string, bool) {
+	for _, prefix := range config.Commands.IgnoreTagPrefixes {
+		if prefix != "" && strings.HasPrefix(event.Tag, prefix) {
+			return fmt.Sprintf("tag %s", event.Tag), true
+		}
+	}
+	if event.Author == nil {
+		return "", false
+	}
+	for _, account := range config.Commands.IgnoreAuthors {
+		if (account == event.Author.Username && account != "") ||
+			(event.Author.Email != "" && strings.EqualFold(account, event.Author.Email)) {
+			return fmt.Sprintf("author %s", account), true
+		}
+	}
+	return "", false
+}
+
+// commandAllowed checks the author of a comment may run a command
+func commandAllowed(cmd *CommentCommand, author *User, groups GerritGroupLister) (bool, error) {
+	permission, ok := config.Commands.Permissions[cmd.Name]
+	if !ok {
+		return true, nil
+	}
+	if author == nil {
+		return false, nil
+	}
+	isAuthor := func(u User) bool {
+		return (u.Username != "" && u.Username == author.Username) ||
+			(u.Email != "" && strings.EqualFold(u.Email, author.Email))
+	}
+	for _, account := range permission.Accounts {
+		if isAuthor(User{Username: account, Email: account}) {
+			return true, nil
+		}
+	}
+	for _, group := range permission.Groups {
+		members, err := groups.ListGroupMembers(group)
+		if err != nil {
+			return false, err
+		}
+		if slices.ContainsFunc(members, isAuthor) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// replyToComment posts a message to the patch set of a comment without voting
+func replyToComment(event Event, message string) error {
+	return setReviewState(event.Context(), gerritClient, &Review{
+		Patch: &backend.Patch{
+			Number:   event.PatchSet.Number,
+			Change:   event.Change.Number,
+			Revision: event.PatchSet.Revision,
+		},
+		Message:  message,
+		OmitVote: true,
+	})
+}
+
+// createCommentBuild creates a build of the patch set of a comment on the pipeline named by args,
+// or chosen by the hashtags of the change
+func createCommentBuild(event Event, pipelineName string, p BuildPipeline, b backend.Backend, env map[string]string) error {
+	if pipelineName == "" {
+		pipelineName = config.Hashtags.PipelineOf(event.Change)
+	}
+	pipeline, err := pipelineByName(pipelineName, p)
+	if err != nil {
+		if replyErr := replyToComment(event, fmt.Sprintf("%s. Known pipelines: %s", err, strings.Join(pipelineNames(), ", "))); replyErr != nil {
+			log.Err(replyErr).Int("change", event.Change.Number).Msg("Failed to reply to comment")
+		}
+		return err
+	}
+	patch := &backend.Patch{
+		Number:   event.PatchSet.Number,
+		Change:   event.Change.Number,
+		Revision: event.PatchSet.Revision,
+	}
+	log.Debug().
+		Str("eventType", event.Type).
+		Str("patchRevision", patch.Revision).
+		Int("change", patch.Change).
+		Int("patchNumber", patch.Number).
+		Str("pipeline", pipeline.Slug()).
+		Msg("Creating build")
+	build := newCreateBuild(event)
+	for name, value := range env {
+		build.Env[name] = value
+	}
+	chain, err := dependencyChain(event)
+	if err != nil {
+		log.Warn().Err(err).Int("change", patch.Change).Msg("Failed to resolve the relation chain, building without it")
+	}
+	tagDependencies(build, chain)
+	if _, err := createAndSaveBuild(pipeline, b, event, build); err != nil {
+		return err
+	}
+	if config.Dependencies.WaitForParent {
+		return nil
+	}
+	// A rebuilt parent change rebuilds the changes which depend on it
+	return queueChildBuilds(event, p, b)
+}
+
+func handleRetestComment(event Event, args []string, p BuildPipeline, b backend.Backend) error {
+	log.Info().
+		Str("eventType", event.Type).
+		Int("patch", event.PatchSet.Number).
+		Int("change", event.Change.Number).
+		Strs("args", args).
+		Msg("Retesting patchset")
+	if len(args) > 1 {
+		return fmt.Errorf("usage: %s", findCommentCommand("retest").Usage)
+	}
+	pipelineName := ""
+	if len(args) == 1 {
+		pipelineName = args[0]
+	}
+	return createCommentBuild(event, pipelineName, p, b, nil)
+}
+
+func handleRebuildComment(event Event, args []string, p BuildPipeline, b backend.Backend) error {
+	flags := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	clean := flags.Bool("clean", false, "Build from a clean checkout")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		return fmt.Errorf("usage: %s", findCommentCommand("rebuild").Usage)
+	}
+	log.Info().
+		Str("eventType", event.Type).
+		Int("patch", event.PatchSet.Number).
+		Int("change", event.Change.Number).
+		Bool("clean", *clean).
+		Msg("Rebuilding patchset")
+	env := map[string]string{}
+	if *clean {
+		env["BUILDKITE_CLEAN_CHECKOUT"] = "true"
+	}
+	return createCommentBuild(event, flags.Arg(0), p, b, env)
+}
+
+// pipelineNames returns the names of the registered pipelines
+func pipelineNames() []string {
+	names := make([]string, 0, len(pipelines))
+	for name := range pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandHelp describes the registered commands
+func commandHelp() string {
+	prefix := config.Commands.Prefixes[0]
+	help := &strings.Builder{}
+	fmt.Fprintln(help, "Commands, each on a line of its own:")
+	for _, cmd := range commentCommands {
+		fmt.Fprintf(help, "\n* `%s%s` %s", prefix, cmd.Usage, cmd.Description)
+		if _, restricted := config.Commands.Permissions[cmd.Name]; restricted {
+			fmt.Fprint(help, " (restricted)")
+		}
+	}
+	if len(pipelines) > 0 {
+		fmt.Fprintf(help, "\n\nPipelines: %s", strings.Join(pipelineNames(), ", "))
+	}
+	return help.String()
+}
+
+func handleHelpComment(event Event, args []string, p BuildPipeline, b backend.Backend) error {
+	return replyToComment(event, commandHelp())
+}
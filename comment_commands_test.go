@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// withConfig replaces the config and named pipelines for the duration of a test
+func withConfig(t *testing.T, c *Config, named map[string]BuildPipeline) {
+	t.Helper()
+	prevConfig, prevPipelines := config, pipelines
+	config, pipelines = c, named
+	t.Cleanup(func() {
+		config, pipelines = prevConfig, prevPipelines
+	})
+}
+
+// withGerrit replaces the Gerrit client of handlers for the duration of a test
+func withGerrit(t *testing.T, g GerritClient) {
+	t.Helper()
+	prev := gerritClient
+	gerritClient = g
+	t.Cleanup(func() {
+		gerritClient = prev
+	})
+}
+
+func TestParseCommandLine(t *testing.T) {
+	for _, tc := range []struct {
+		line   string
+		prefix string
+		name   string
+		args   []string
+		ok     bool
+	}{
+		{"retest", "", "retest", []string{}, true},
+		{"retest full-ci", "", "retest", []string{"full-ci"}, true},
+		{"rebuild --clean full-ci", "", "rebuild", []string{"--clean", "full-ci"}, true},
+		{"/retest", "/", "retest", []string{}, true},
+		{"retest", "/", "", nil, false},
+		{"retest ", "", "", nil, false},
+		{" retest", "", "", nil, false},
+		{"retest  full-ci", "", "", nil, false},
+		{"/", "/", "", nil, false},
+	} {
+		name, args, ok := parseCommandLine(tc.line, tc.prefix)
+		if name != tc.name || ok != tc.ok || fmt.Sprint(args) != fmt.Sprint(tc.args) {
+			t.Errorf("parseCommandLine(%q, %q) = %q, %q, %v; expected %q, %q, %v", tc.line, tc.prefix, name, args, ok, tc.name, tc.args, tc.ok)
+		}
+	}
+}
+
+func TestItRunsTheFirstRegisteredCommandInAComment(t *testing.T) {
+	invocation, ok := findCommandInvocation("help\nretest", []string{""})
+	if !ok {
+		t.Fatal("Expected a command to be found")
+	}
+	if invocation.Command.Name != "retest" {
+		t.Errorf("Expected retest to run before help, but got %s", invocation.Command.Name)
+	}
+}
+
+func TestItTriesEveryPrefix(t *testing.T) {
+	invocation, ok := findCommandInvocation("/retest", []string{"", "/"})
+	if !ok || invocation.Command.Name != "retest" {
+		t.Errorf("Expected /retest to match the / prefix, but got %+v", invocation)
+	}
+}
+
+func TestItAcceptsConfiguredPrefixes(t *testing.T) {
+	c := defaultConfig()
+	c.Commands.Prefixes = []string{"/", "ci "}
+	withConfig(t, c, map[string]BuildPipeline{})
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	event := Event{Comment: "ci retest"}
+
+	HandleCommentAdded(event, p, b)
+	if p.FunctionCallCounter["CreateBuild"] != 1 {
+		t.Errorf("Expected CreateBuild to be called once, but it was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+	p.Reset("CreateBuild")
+	event.Comment = "retest"
+	HandleCommentAdded(event, p, b)
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Errorf("Expected a bare command to be ignored, but CreateBuild was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+}
+
+func TestItRetestsOnANamedPipeline(t *testing.T) {
+	full := NewMockPipeline()
+	full.MockSlug = "full-pipeline"
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{"full-ci": full})
+	gerrit := NewMockGerrit()
+	withGerrit(t, gerrit)
+	p := NewMockPipeline()
+	b := NewMockBackend()
+
+	HandleCommentAdded(Event{Comment: "retest full-ci"}, p, b)
+	if p.FunctionCallCounter["CreateBuild"] != 0 || full.FunctionCallCounter["CreateBuild"] != 1 {
+		t.Errorf("Expected the build on full-ci only, but default=%d full-ci=%d", p.FunctionCallCounter["CreateBuild"], full.FunctionCallCounter["CreateBuild"])
+	}
+
+	if err := HandleCommentAdded(Event{Comment: "retest unknown"}, p, b); err == nil {
+		t.Error("Expected an error for an unknown pipeline")
+	}
+	if gerrit.FunctionCallCounter["SetReviewState"] != 1 {
+		t.Errorf("Expected the unknown pipeline to be reported, but SetReviewState was called %d times", gerrit.FunctionCallCounter["SetReviewState"])
+	}
+}
+
+func TestItRebuildsFromACleanCheckout(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	p := NewMockPipeline()
+	var created *buildkite.CreateBuild
+	p.MockCreateBuild = func(build *buildkite.CreateBuild) (int, error) {
+		created = build
+		return 1, nil
+	}
+
+	HandleCommentAdded(Event{Comment: "rebuild --clean"}, p, NewMockBackend())
+	if created == nil || created.Env["BUILDKITE_CLEAN_CHECKOUT"] != "true" {
+		t.Errorf("Expected a clean checkout build, but got %+v", created)
+	}
+}
+
+func TestItChecksCommandPermissions(t *testing.T) {
+	c := defaultConfig()
+	c.Commands.Permissions["retest"] = CommandPermission{
+		Accounts: []string{"jane"},
+		Groups:   []string{"Maintainers"},
+	}
+	withConfig(t, c, map[string]BuildPipeline{})
+	gerrit := NewMockGerrit()
+	gerrit.MockListGroupMembers = func(group string) ([]User, error) {
+		return []User{{Username: "sam", Email: "sam@example.com"}}, nil
+	}
+	var denied *Review
+	gerrit.MockSetReviewState = func(r *Review) error {
+		denied = r
+		return nil
+	}
+	withGerrit(t, gerrit)
+	p := NewMockPipeline()
+	b := NewMockBackend()
+
+	for _, author := range []*User{{Username: "jane"}, {Email: "SAM@example.com"}} {
+		p.Reset("CreateBuild")
+		HandleCommentAdded(Event{Comment: "retest", Author: author}, p, b)
+		if p.FunctionCallCounter["CreateBuild"] != 1 {
+			t.Errorf("Expected %+v to be allowed to retest", author)
+		}
+	}
+
+	p.Reset("CreateBuild")
+	HandleCommentAdded(Event{Comment: "retest", Author: &User{Username: "mallory"}}, p, b)
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Error("Expected mallory not to be allowed to retest")
+	}
+	if denied == nil || !denied.OmitVote {
+		t.Errorf("Expected the denial to be posted without a vote, but got %+v", denied)
+	}
+}
+
+func TestItPostsHelp(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{"full-ci": NewMockPipeline()})
+	gerrit := NewMockGerrit()
+	var help *Review
+	gerrit.MockSetReviewState = func(r *Review) error {
+		help = r
+		return nil
+	}
+	withGerrit(t, gerrit)
+
+	HandleCommentAdded(Event{Comment: "help"}, NewMockPipeline(), NewMockBackend())
+	if help == nil {
+		t.Fatal("Expected help to be posted")
+	}
+	for _, expected := range []string{"retest [pipeline]", "rebuild [--clean] [pipeline]", "full-ci"} {
+		if !strings.Contains(help.Message, expected) {
+			t.Errorf("Expected help to contain %q, but got %q", expected, help.Message)
+		}
+	}
+	if !help.OmitVote {
+		t.Error("Expected help to be posted without a vote")
+	}
+}
+
+func TestParseMembersOutput(t *testing.T) {
+	output := "id\tusername\tfull name\temail\n1000000\tjane\tJane Doe\tjane@example.com\n1000001\tn/a\tBot\tn/a\n"
+	members, err := parseMembersOutput([]byte(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members[0].Username != "jane" || members[1].Username != "" || members[1].Email != "" {
+		t.Errorf("Unexpected members %+v", members)
+	}
+}
+
+func TestItRejectsPermissionsForUnknownCommands(t *testing.T) {
+	c := defaultConfig()
+	c.Commands.Permissions["deploy"] = CommandPermission{Accounts: []string{"jane"}}
+	if err := c.Validate(); err == nil {
+		t.Error("Expected a permission for an unknown command to be rejected")
+	}
+}
+
+func TestItIgnoresCommentsByBots(t *testing.T) {
+	c := defaultConfig()
+	c.Commands.IgnoreAuthors = []string{"ci-bot", "builds@example.com"}
+	withConfig(t, c, map[string]BuildPipeline{})
+	p := NewMockPipeline()
+	b := NewMockBackend()
+
+	for _, event := range []Event{
+		{Comment: "Build 1 Failed\nretest", Author: &User{Username: "ci-bot"}},
+		{Comment: "retest", Author: &User{Email: "Builds@example.com"}},
+		{Comment: "retest", Author: &User{Username: "jane"}, Tag: "autogenerated:buildkite"},
+	} {
+		HandleCommentAdded(event, p, b)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Errorf("Expected bot comments to be ignored, but CreateBuild was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+
+	HandleCommentAdded(Event{Comment: "retest", Author: &User{Username: "jane"}}, p, b)
+	if p.FunctionCallCounter["CreateBuild"] != 1 {
+		t.Errorf("Expected CreateBuild to be called once, but it was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+}
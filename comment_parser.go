@@ -0,0 +1,40 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// patchSetHeader is the first line Gerrit adds to a comment with the votes cast with it
+	// Ex: Patch Set 3: Code-Review+1 Verified-1
+	patchSetHeader = regexp.MustCompile(`^Patch Set \d+:.*$`)
+	// inlineCommentCount is added by Gerrit when a comment has inline comments. Ex: (2 comments)
+	inlineCommentCount = regexp.MustCompile(`^\(\d+ comments?\)$`)
+	// voteLine is a vote summary on a line of its own. Ex: Code-Review+2 or -Verified
+	voteLine = regexp.MustCompile(`^(-?[A-Z][A-Za-z]*(-[A-Z][A-Za-z]*)*([+-]\d+)?\s*)+$`)
+)
+
+// parseCommentBody returns the lines written by the author of a Gerrit comment.
+// The "Patch Set N:" header, vote summaries, inline comment counts and quoted replies are removed.
+func parseCommentBody(comment string) []string {
+	lines := strings.Split(strings.ReplaceAll(comment, "\r\n", "\n"), "\n")
+	body := []string{}
+	authored := false
+	for i, line := range lines {
+		switch {
+		case i == 0 && patchSetHeader.MatchString(line):
+			continue
+		case strings.HasPrefix(strings.TrimLeft(line, " \t"), ">"):
+			continue
+		case inlineCommentCount.MatchString(line):
+			continue
+		case !authored && voteLine.MatchString(line) && strings.ContainsAny(line, "+-"):
+			// Only the boilerplate before the first line written by the author holds votes
+			continue
+		}
+		authored = authored || strings.TrimSpace(line) != ""
+		body = append(body, line)
+	}
+	return body
+}
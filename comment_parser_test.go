@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseCommentBody(t *testing.T) {
+	for _, tc := range []struct {
+		comment  string
+		expected []string
+	}{
+		{"retest", []string{"retest"}},
+		{"Patch Set 3:\n\nretest", []string{"", "retest"}},
+		{"Patch Set 3: Code-Review+1 Verified-1\n\n(2 comments)\n\nretest", []string{"", "", "retest"}},
+		{"Patch Set 3:\n\nCode-Review+2\n\nretest", []string{"", "", "retest"}},
+		{"Patch Set 3: -Code-Review\n\n> retest\n\nWhy retest?", []string{"", "", "Why retest?"}},
+		{"Looks good\nCode-Review+2", []string{"Looks good", "Code-Review+2"}},
+	} {
+		body := parseCommentBody(tc.comment)
+		if fmt.Sprintf("%q", body) != fmt.Sprintf("%q", tc.expected) {
+			t.Errorf("parseCommentBody(%q) = %q; expected %q", tc.comment, body, tc.expected)
+		}
+	}
+}
+
+func TestItIgnoresQuotedCommands(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	p := NewMockPipeline()
+
+	HandleCommentAdded(Event{Comment: "Patch Set 2:\n\n> retest\n\nThis was retested already"}, p, NewMockBackend())
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Errorf("Expected a quoted retest to be ignored, but CreateBuild was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+
+	HandleCommentAdded(Event{Comment: "Patch Set 2: Code-Review+1\n\nretest"}, p, NewMockBackend())
+	if p.FunctionCallCounter["CreateBuild"] != 1 {
+		t.Errorf("Expected CreateBuild to be called once, but it was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+}
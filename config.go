@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the YAML configuration of --config-path. Features which need more than a flag read it.
+var config = defaultConfig()
+
+// Config is the YAML configuration file
+//
+//	pipelines:
+//	  full-ci: my-pipeline-full
+//	commands:
+//	  prefixes: ["", "/"]
+//	  ignore_authors: [ci-bot]
+//	  ignore_tag_prefixes: ["autogenerated:"]
+//	  permissions:
+//	    retest:
+//	      accounts: [jane]
+//	      groups: [Maintainers]
+//	vote_triggers:
+//	  - label: Code-Review
+//	    value: 2
+//	post_merge:
+//	  branches: [main]
+//	carry_forward:
+//	  kinds: [TRIVIAL_REBASE]
+//	build:
+//	  env:
+//	    GERRIT_TOPIC: "{{ .Change.Topic }}"
+//	results:
+//	  canceled: omit
+//	  stale: drop
+//	messages:
+//	  failed: "[CI failed]({{ .Build.WebURL }}) after {{ .Duration }}"
+//	notify:
+//	  levels:
+//	    failed: OWNER
+//	attention:
+//	  on_failure: true
+//	hashtags:
+//	  pipelines:
+//	    full-ci: full
+//	topic_builds:
+//	  enabled: true
+//	dependencies:
+//	  enabled: true
+type Config struct {
+	// Pipelines are Buildkite pipeline slugs by name, in the organization of --buildkite-org-slug
+	Pipelines map[string]string `yaml:"pipelines"`
+	Commands  CommandsConfig    `yaml:"commands"`
+	// VoteTriggers create builds when a label is voted
+	VoteTriggers []VoteTrigger `yaml:"vote_triggers"`
+	// PostMerge builds branches after changes are merged
+	PostMerge PostMergeConfig `yaml:"post_merge"`
+	// CarryForward reuses the build of the previous patch set for trivial patch sets
+	CarryForward CarryForwardConfig `yaml:"carry_forward"`
+	// Build configures the message, env and meta-data of builds of patch sets
+	Build BuildConfig `yaml:"build"`
+	// Results configures the votes of builds which neither passed nor failed
+	Results ResultsConfig `yaml:"results"`
+	// Messages are templates of review messages by build state
+	Messages MessagesConfig `yaml:"messages"`
+	// Notify configures who is emailed about build results
+	Notify NotifyConfig `yaml:"notify"`
+	// Attention configures the attention set and reviewers of failed builds
+	Attention AttentionConfig `yaml:"attention"`
+	// Hashtags control the builds of a change by its hashtags and topic
+	Hashtags HashtagsConfig `yaml:"hashtags"`
+	// TopicBuilds builds the open changes of a topic together
+	TopicBuilds TopicBuildsConfig `yaml:"topic_builds"`
+	// Dependencies build stacked changes with the changes they depend on
+	Dependencies DependenciesConfig `yaml:"dependencies"`
+}
+
+// CommandsConfig configures comment commands
+type CommandsConfig struct {
+	// Prefixes one of which must start a command line. An empty prefix allows bare commands
+	Prefixes []string `yaml:"prefixes"`
+	// Permissions restrict who may run a command by command name. Commands without one may be run by anyone
+	Permissions map[string]CommandPermission `yaml:"permissions"`
+	// IgnoreAuthors are Gerrit usernames or emails of bots and service accounts whose comments never run commands
+	IgnoreAuthors []string `yaml:"ignore_authors"`
+	// IgnoreTagPrefixes skip comments with a tag starting with one of them. Ex: autogenerated:
+	IgnoreTagPrefixes []string `yaml:"ignore_tag_prefixes"`
+}
+
+// CommandPermission allows accounts and members of groups to run a command
+type CommandPermission struct {
+	// Accounts are Gerrit usernames or emails
+	Accounts []string `yaml:"accounts"`
+	// Groups are Gerrit group names or UUIDs
+	Groups []string `yaml:"groups"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Pipelines: map[string]string{},
+		Commands: CommandsConfig{
+			Prefixes:          []string{""},
+			Permissions:       map[string]CommandPermission{},
+			IgnoreAuthors:     []string{},
+			IgnoreTagPrefixes: []string{"autogenerated:"},
+		},
+		Build:     defaultBuildConfig(),
+		Results:   defaultResultsConfig(),
+		Messages:  defaultMessagesConfig(),
+		Notify:    defaultNotifyConfig(),
+		Attention: defaultAttentionConfig(),
+		Hashtags:  defaultHashtagsConfig(),
+	}
+}
+
+// loadConfig reads a YAML configuration file over the defaults
+func loadConfig(path string) (*Config, error) {
+	c := defaultConfig()
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return c, c.Validate()
+}
+
+// Validate checks the configuration refers to things which exist
+func (c *Config) Validate() error {
+	for name, slug := range c.Pipelines {
+		if slug == "" {
+			return fmt.Errorf("pipeline %q has no slug", name)
+		}
+	}
+	if len(c.Commands.Prefixes) == 0 {
+		return fmt.Errorf("commands.prefixes must not be empty")
+	}
+	for name := range c.Commands.Permissions {
+		if findCommentCommand(name) == nil {
+			return fmt.Errorf("permission for unknown command %q", name)
+		}
+	}
+	if err := validateVoteTriggers(c.VoteTriggers, c.Pipelines); err != nil {
+		return err
+	}
+	if err := c.PostMerge.Validate(c.Pipelines); err != nil {
+		return err
+	}
+	if err := c.CarryForward.Validate(); err != nil {
+		return err
+	}
+	if err := c.Build.Validate(); err != nil {
+		return err
+	}
+	if err := c.Results.Validate(); err != nil {
+		return err
+	}
+	if err := c.Messages.Validate(); err != nil {
+		return err
+	}
+	if err := c.Notify.Validate(); err != nil {
+		return err
+	}
+	if err := c.Attention.Validate(); err != nil {
+		return err
+	}
+	if err := c.Hashtags.Validate(c.Pipelines); err != nil {
+		return err
+	}
+	if err := c.Dependencies.Validate(); err != nil {
+		return err
+	}
+	return c.TopicBuilds.Validate(c.Pipelines)
+}
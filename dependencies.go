@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxDependencyChain stops resolving relation chains which are longer than any stack of changes
+	maxDependencyChain = 50
+	// eventTypeParentBuilt is the event type of builds of a change queued by a build of its parent change
+	eventTypeParentBuilt = "parent-built"
+)
+
+// DependenciesConfig builds stacked changes with the open changes they depend on
+//
+//	dependencies:
+//	  enabled: true
+//	  wait_for_parent: true
+type DependenciesConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// WaitForParent builds a change once the build of its parent change passed, instead of when the parent is built
+	WaitForParent bool `yaml:"wait_for_parent"`
+}
+
+// Validate checks wait_for_parent is only set with dependencies enabled
+func (c DependenciesConfig) Validate() error {
+	if c.WaitForParent && !c.Enabled {
+		return fmt.Errorf("dependencies.wait_for_parent needs dependencies.enabled")
+	}
+	return nil
+}
+
+// runChildBuilds runs the builds of child changes queued by passed builds off the webhook consumer
+var runChildBuilds = func(queue func()) {
+	go queue()
+}
+
+// dependency is an open change a patch set is based on and its patch set in the relation chain
+type dependency struct {
+	Change   Change
+	PatchSet PatchSet
+}
+
+// dependencyChain follows the first parent of the patch set of an event through open changes.
+// It returns them from the bottom of the stack to the parent of the patch set, or nil when dependencies are disabled.
+func dependencyChain(event Event) ([]dependency, error) {
+	if !config.Dependencies.Enabled {
+		return nil, nil
+	}
+	chain := []dependency{}
+	parents := event.PatchSet.Parents
+	for len(parents) > 0 && len(chain) < maxDependencyChain {
+		revision := parents[0]
+		changes, err := gerritClient.QueryChanges(fmt.Sprintf("commit:%s status:open", revision))
+		if err != nil {
+			return nil, err
+		}
+		var parent *dependency
+		for _, c := range changes {
+			if ps, ok := c.GetPatchSetByRevision(revision); ok && c.Number != event.Change.Number {
+				parent = &dependency{Change: c.Change, PatchSet: *ps}
+				break
+			}
+		}
+		// The parent commit is merged or was never a change
+		if parent == nil {
+			break
+		}
+		if slices.ContainsFunc(chain, func(d dependency) bool { return d.Change.Number == parent.Change.Number }) {
+			break
+		}
+		chain = append([]dependency{*parent}, chain...)
+		parents = parent.PatchSet.Parents
+	}
+	return chain, nil
+}
+
+// tagDependencies passes the refs and numbers of the changes a build depends on in its env, bottom of the stack first
+func tagDependencies(build *buildkite.CreateBuild, chain []dependency) {
+	if len(chain) == 0 {
+		return
+	}
+	refspecs, numbers := []string{}, []string{}
+	for _, d := range chain {
+		refspecs = append(refspecs, d.PatchSet.Ref)
+		numbers = append(numbers, fmt.Sprint(d.Change.Number))
+	}
+	if build.Env == nil {
+		build.Env = map[string]string{}
+	}
+	build.Env["GERRIT_DEPENDS_REFSPECS"] = strings.Join(refspecs, " ")
+	build.Env["GERRIT_DEPENDS_CHANGES"] = strings.Join(numbers, " ")
+}
+
+// recordDependency saves the change of an event as a child of its parent change
+func recordDependency(event Event, b backend.Backend, chain []dependency) {
+	if len(chain) == 0 {
+		return
+	}
+	parent := chain[len(chain)-1].Change.Number
+	if err := b.AddChildChange(event.Context(), parent, event.Change.Number); err != nil {
+		log.Err(err).
+			Int("change", event.Change.Number).
+			Int("parentChange", parent).
+			Msg("Failed to save the parent change")
+	}
+}
+
+// parentPending returns the parent change of an event when the build of its patch set has not passed.
+// A parent without a known build does not hold its children back.
+func parentPending(event Event, b backend.Backend, chain []dependency) (*dependency, bool) {
+	if !config.Dependencies.WaitForParent || len(chain) == 0 {
+		return nil, false
+	}
+	parent := &chain[len(chain)-1]
+	pb, err := b.GetPatch(event.Context(), &backend.Patch{Number: parent.PatchSet.Number, Change: parent.Change.Number})
+	if err != nil && err != backend.ErrBuildNotFound {
+		log.Err(err).
+			Int("change", event.Change.Number).
+			Int("parentChange", parent.Change.Number).
+			Msg("Failed to find the build of the parent change")
+	}
+	if err != nil || pb == nil {
+		return parent, false
+	}
+	return parent, pb.State != "passed"
+}
+
+// createChainBuild builds the patch set of an event with its relation chain unless it waits for its parent change,
+// then queues the builds of its children. An empty pipeline name uses the pipeline chosen by the hashtags of the change.
+func createChainBuild(event Event, pipelineName string, p BuildPipeline, b backend.Backend, chain []dependency) error {
+	if pipelineName == "" {
+		pipelineName = config.Hashtags.PipelineOf(event.Change)
+	}
+	pipeline, err := pipelineByName(pipelineName, p)
+	if err != nil {
+		return err
+	}
+	recordDependency(event, b, chain)
+	if parent, pending := parentPending(event, b, chain); pending {
+		log.Info().
+			Int("change", event.Change.Number).
+			Int("patch", event.PatchSet.Number).
+			Int("parentChange", parent.Change.Number).
+			Msg("Waiting for the build of the parent change")
+		// Every later event of the patch set waits too, the message is posted once
+		first, err := b.MarkPatchWaiting(event.Context(), &backend.Patch{Number: event.PatchSet.Number, Change: event.Change.Number})
+		if err != nil || !first {
+			return err
+		}
+		return replyToComment(event, fmt.Sprintf("Waiting for the build of Change %d Patch %d to pass", parent.Change.Number, parent.PatchSet.Number))
+	}
+	built := false
+	if config.TopicBuilds.Enabled && event.Change.Topic != "" {
+		if built, err = createTopicBuild(event, pipeline, b, chain); err != nil {
+			return err
+		}
+	}
+	if !built {
+		build := newCreateBuild(event)
+		tagDependencies(build, chain)
+		if _, err := createAndSaveBuild(pipeline, b, event, build); err != nil {
+			return err
+		}
+	}
+	if config.Dependencies.WaitForParent {
+		// Children are built when this build passes
+		return nil
+	}
+	return queueChildBuilds(event, p, b)
+}
+
+// queueChildBuilds builds the open changes recorded as children of the change of an event
+// which still depend on it. Their own children follow.
+func queueChildBuilds(event Event, p BuildPipeline, b backend.Backend) error {
+	if !config.Dependencies.Enabled {
+		return nil
+	}
+	children, err := b.GetChildChanges(event.Context(), event.Change.Number)
+	if err != nil {
+		return err
+	}
+	failed := []error{}
+	for _, child := range children {
+		childEvent, open, err := withCurrentPatchSet(Event{
+			Type:   eventTypeParentBuilt,
+			Change: Change{Number: child},
+		}.WithContext(event.Context()))
+		if err != nil {
+			failed = append(failed, fmt.Errorf("child change %d: %w", child, err))
+			continue
+		}
+		if !open || buildSkipped(childEvent) {
+			continue
+		}
+		if childBuildPending(childEvent, b) {
+			log.Info().
+				Int("change", child).
+				Int("patch", childEvent.PatchSet.Number).
+				Int("parentChange", event.Change.Number).
+				Msg("Child change already has an unfinished build")
+			continue
+		}
+		chain, err := dependencyChain(childEvent)
+		if err != nil {
+			failed = append(failed, fmt.Errorf("child change %d: %w", child, err))
+			continue
+		}
+		if !slices.ContainsFunc(chain, func(d dependency) bool { return d.Change.Number == event.Change.Number }) {
+			log.Debug().
+				Int("change", child).
+				Int("parentChange", event.Change.Number).
+				Msg("Change no longer depends on the parent change")
+			continue
+		}
+		log.Info().
+			Int("change", child).
+			Int("patch", childEvent.PatchSet.Number).
+			Int("parentChange", event.Change.Number).
+			Msg("Building child change")
+		if err := createChainBuild(childEvent, "", p, b, chain); err != nil {
+			failed = append(failed, fmt.Errorf("child change %d: %w", child, err))
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// childBuildPending checks the current patch set of a child change already has an unfinished build.
+// Pushing a stack builds each of its changes, which would otherwise each rebuild the changes above them.
+func childBuildPending(event Event, b backend.Backend) bool {
+	pb, err := b.GetPatch(event.Context(), &backend.Patch{Number: event.PatchSet.Number, Change: event.Change.Number})
+	if err != nil || pb == nil {
+		return false
+	}
+	return !buildFinished(pb.State)
+}
+
+// queuePassedChildBuilds builds the children of the patch sets of a passed build, in the background,
+// when they wait for their parent
+func queuePassedChildBuilds(ctx context.Context, webhook BuildkiteWebhook, p BuildPipeline, b backend.Backend, pb *backend.PatchBuild) {
+	if !config.Dependencies.Enabled || !config.Dependencies.WaitForParent ||
+		webhook.Build.State != "passed" || pb.Trigger == backend.TriggerPostMerge {
+		return
+	}
+	// The Gerrit queries and builds of the children would hold up the webhooks after this one
+	ctx = context.WithoutCancel(ctx)
+	runChildBuilds(func() {
+		for _, parent := range topicPatchBuilds(webhook.Build, pb) {
+			parentEvent := Event{
+				Change:   Change{Number: parent.Change},
+				PatchSet: PatchSet{Number: parent.Number},
+			}.WithContext(ctx)
+			if err := queueChildBuilds(parentEvent, p, b); err != nil {
+				log.Err(err).
+					Int("change", parent.Change).
+					Msg("Failed to build child changes")
+			}
+		}
+	})
+}
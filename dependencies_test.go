@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+// stackChanges are change 43 on top of 42 on top of 41, whose parent is merged
+var stackChanges = map[string][]QueriedChange{
+	"commit:rev41 status:open": {{Change: Change{Number: 41}, Open: true, CurrentPatchSet: &PatchSet{Number: 1, Revision: "rev41", Ref: "refs/changes/41/41/1", Parents: []string{"merged"}}}},
+	"commit:rev42 status:open": {{Change: Change{Number: 42}, Open: true, CurrentPatchSet: &PatchSet{Number: 2, Revision: "rev42", Ref: "refs/changes/42/42/2", Parents: []string{"rev41"}}}},
+	"change:43":                {{Change: Change{Number: 43}, Open: true, CurrentPatchSet: &PatchSet{Number: 1, Revision: "rev43", Ref: "refs/changes/43/43/1", Parents: []string{"rev42"}}}},
+}
+
+func TestItBuildsStackedChangesWithTheirRelationChain(t *testing.T) {
+	c := defaultConfig()
+	c.Dependencies.Enabled = true
+	withConfig(t, c, map[string]BuildPipeline{})
+	withGerrit(t, NewMockGerritChanges(stackChanges))
+	p := NewMockPipeline()
+	var built *buildkite.CreateBuild
+	p.MockCreateBuild = func(build *buildkite.CreateBuild) (int, error) {
+		built = build
+		return 1, nil
+	}
+	b := NewMockBackend()
+	children := map[int]int{}
+	b.MockAddChildChange = func(ctx context.Context, parent, child int) error {
+		children[child] = parent
+		return nil
+	}
+
+	event := Event{Type: "patchset-created", Change: Change{Number: 43}, PatchSet: PatchSet{Number: 1, Parents: []string{"rev42"}}}
+	if err := HandlePatchsetCreated(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if refspecs := built.Env["GERRIT_DEPENDS_REFSPECS"]; refspecs != "refs/changes/41/41/1 refs/changes/42/42/2" {
+		t.Errorf("Unexpected refspecs %q", refspecs)
+	}
+	if changes := built.Env["GERRIT_DEPENDS_CHANGES"]; changes != "41 42" {
+		t.Errorf("Unexpected changes %q", changes)
+	}
+	if children[43] != 42 {
+		t.Errorf("Expected change 43 to be saved as a child of 42, but got %v", children)
+	}
+}
+
+func TestItBuildsStackedChangesOfATopicWithTheirRelationChain(t *testing.T) {
+	c := defaultConfig()
+	c.Dependencies.Enabled = true
+	c.TopicBuilds.Enabled = true
+	withConfig(t, c, map[string]BuildPipeline{})
+	changes := maps.Clone(stackChanges)
+	changes[`topic:"cross" status:open`] = []QueriedChange{
+		{Change: Change{Number: 50, Project: "api"}, Open: true, CurrentPatchSet: &PatchSet{Number: 1, Ref: "refs/changes/50/50/1"}},
+	}
+	withGerrit(t, NewMockGerritChanges(changes))
+	p := NewMockPipeline()
+	var built *buildkite.CreateBuild
+	p.MockCreateBuild = func(build *buildkite.CreateBuild) (int, error) {
+		built = build
+		return 1, nil
+	}
+	b := NewMockBackend()
+
+	event := Event{Type: "patchset-created", Change: Change{Number: 43, Topic: "cross"}, PatchSet: PatchSet{Number: 1, Parents: []string{"rev42"}}}
+	if err := HandlePatchsetCreated(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if built == nil || built.Env["GERRIT_TOPIC_CHANGES"] != "43 50" {
+		t.Fatalf("Expected a topic build, but got %+v", built)
+	}
+	if changes := built.Env["GERRIT_DEPENDS_CHANGES"]; changes != "41 42" {
+		t.Errorf("Expected the topic build to have the relation chain, but got %q", changes)
+	}
+}
+
+func TestItWaitsForTheBuildOfTheParentChange(t *testing.T) {
+	c := defaultConfig()
+	c.Dependencies = DependenciesConfig{Enabled: true, WaitForParent: true}
+	withConfig(t, c, map[string]BuildPipeline{})
+	// Child builds finish before the webhook handler returns
+	run := runChildBuilds
+	runChildBuilds = func(queue func()) { queue() }
+	t.Cleanup(func() { runChildBuilds = run })
+	g := NewMockGerritChanges(stackChanges)
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	parentState := "running"
+	b.MockGetPatch = func(ctx context.Context, patch *backend.Patch) (*backend.PatchBuild, error) {
+		if patch.Change != 42 || patch.Number != 2 {
+			return nil, backend.ErrBuildNotFound
+		}
+		return &backend.PatchBuild{Patch: patch, BuildNumber: 5, State: parentState}, nil
+	}
+	var review *Review
+	g.MockSetReviewState = func(r *Review) error {
+		review = r
+		return nil
+	}
+	withGerrit(t, g)
+
+	event := Event{Type: "patchset-created", Change: Change{Number: 43}, PatchSet: PatchSet{Number: 1, Parents: []string{"rev42"}}}
+	if err := HandlePatchsetCreated(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Error("Expected the child change to wait for its parent")
+	}
+	if review == nil || !review.OmitVote || !strings.Contains(review.Message, "Change 42 Patch 2") {
+		t.Errorf("Expected a message naming the parent change, but got %+v", review)
+	}
+
+	// Later events of the patch set wait without repeating the message
+	b.MockMarkPatchWaiting = func(ctx context.Context, patch *backend.Patch) (bool, error) {
+		return false, nil
+	}
+	review = nil
+	if err := HandleChangeRestored(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if review != nil || p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Errorf("Expected the child change to keep waiting quietly, but got %+v", review)
+	}
+
+	// The child change builds when the build of its parent passes
+	parentState = "passed"
+	b.MockGetChildChanges = func(ctx context.Context, parent int) ([]int, error) {
+		if parent == 42 {
+			return []int{43}, nil
+		}
+		return []int{}, nil
+	}
+	webhook := NewMockWebhook(&b, "build.finished", "passed", &backend.Patch{Change: 42, Number: 2})
+	if err := handleWebhookEvent(context.Background(), webhook, g, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 1 {
+		t.Errorf("Expected the child change to build once its parent passed, but CreateBuild was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+}
+
+func TestItRebuildsChildrenWhenTheParentIsRebuilt(t *testing.T) {
+	c := defaultConfig()
+	c.Dependencies.Enabled = true
+	withConfig(t, c, map[string]BuildPipeline{})
+	withGerrit(t, NewMockGerritChanges(stackChanges))
+	p := NewMockPipeline()
+	built := []string{}
+	p.MockCreateBuild = func(build *buildkite.CreateBuild) (int, error) {
+		built = append(built, build.Commit)
+		return len(built), nil
+	}
+	b := NewMockBackend()
+	b.MockGetChildChanges = func(ctx context.Context, parent int) ([]int, error) {
+		// 44 was rebased away from 42
+		return map[int][]int{42: {43, 44}}[parent], nil
+	}
+
+	event := Event{Type: "patchset-created", Change: Change{Number: 42}, PatchSet: PatchSet{Number: 2, Revision: "rev42", Parents: []string{"rev41"}}}
+	if err := HandlePatchsetCreated(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(built, " ") != "rev42 rev43" {
+		t.Errorf("Expected the parent and its child to be built, but built %v", built)
+	}
+
+	// Children pushed with the parent already have a build
+	b.MockGetPatch = func(ctx context.Context, patch *backend.Patch) (*backend.PatchBuild, error) {
+		if patch.Change != 43 {
+			return nil, backend.ErrBuildNotFound
+		}
+		return &backend.PatchBuild{Patch: patch, BuildNumber: 2, State: "scheduled"}, nil
+	}
+	built = []string{}
+	if err := HandlePatchsetCreated(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(built, " ") != "rev42" {
+		t.Errorf("Expected only the parent to be built, but built %v", built)
+	}
+}
+
+func TestItRejectsWaitingForParentsWithoutDependencies(t *testing.T) {
+	c := defaultConfig()
+	c.Dependencies = DependenciesConfig{WaitForParent: true}
+	if err := c.Validate(); err == nil {
+		t.Error("Expected wait_for_parent without enabled to be rejected")
+	}
+}
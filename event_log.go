@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// recentEvents keeps the last Gerrit events dispatched to handlers and their outcomes
+var recentEvents = NewEventLog(100)
+
+// HandlerOutcome is the result of one handler for an event
+type HandlerOutcome struct {
+	Handler  string        `json:"handler"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// EventRecord is a dispatched Gerrit event and the outcomes of its handlers
+type EventRecord struct {
+	ReceivedAt time.Time        `json:"receivedAt"`
+	Type       string           `json:"type"`
+	Project    string           `json:"project,omitempty"`
+	Change     int              `json:"change,omitempty"`
+	Patch      int              `json:"patch,omitempty"`
+	TraceID    string           `json:"traceId,omitempty"`
+	Outcomes   []HandlerOutcome `json:"outcomes"`
+}
+
+// EventLog is a fixed size log of the most recent events
+type EventLog struct {
+	mu      sync.Mutex
+	size    int
+	next    int
+	records []*EventRecord
+}
+
+type eventRecordKey struct{}
+
+// NewEventLog creates an EventLog keeping size records
+func NewEventLog(size int) *EventLog {
+	return &EventLog{size: size}
+}
+
+// Add records an event and returns it carrying its record so handler outcomes can be added
+func (l *EventLog) Add(event Event) Event {
+	record := &EventRecord{
+		ReceivedAt: time.Now(),
+		Type:       event.Type,
+		Project:    event.Change.Project,
+		Change:     event.Change.Number,
+		Patch:      event.PatchSet.Number,
+		TraceID:    event.TraceID(),
+		Outcomes:   []HandlerOutcome{},
+	}
+	if record.Project == "" {
+		record.Project = event.RefUpdate.Project
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.records) < l.size {
+		l.records = append(l.records, record)
+	} else {
+		l.records[l.next] = record
+	}
+	l.next = (l.next + 1) % l.size
+	return event.WithContext(context.WithValue(event.Context(), eventRecordKey{}, record))
+}
+
+// AddOutcome records the outcome of a handler for an event returned by Add
+func (l *EventLog) AddOutcome(event Event, handler string, duration time.Duration, err error) {
+	record, ok := event.Context().Value(eventRecordKey{}).(*EventRecord)
+	if !ok {
+		return
+	}
+	outcome := HandlerOutcome{Handler: handler, Duration: duration}
+	if err != nil {
+		outcome.Error = err.Error()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record.Outcomes = append(record.Outcomes, outcome)
+}
+
+// Recent returns copies of the logged events, newest first
+func (l *EventLog) Recent() []EventRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records := make([]EventRecord, 0, len(l.records))
+	for i := 1; i <= len(l.records); i++ {
+		record := *l.records[(l.next-i+len(l.records))%len(l.records)]
+		record.Outcomes = append([]HandlerOutcome{}, record.Outcomes...)
+		records = append(records, record)
+	}
+	return records
+}
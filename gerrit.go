@@ -1,5 +1,11 @@
 package main
 
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
 // Structure definitions for gerrit events.
 
 type Approval struct {
@@ -26,6 +32,16 @@ type PatchSet struct {
 	Kind           string   `json:"kind,omitempty"`
 	SizeInsertions int      `json:"sizeInsertions,omitempty"`
 	SizeDeletions  int      `json:"sizeDeletions,omitempty"`
+	// Files are only set by `gerrit query --files`
+	Files []PatchSetFile `json:"files,omitempty"`
+}
+
+// PatchSetFile is a file changed by a patch set. Ex: {"file": "main.go", "type": "MODIFIED"}
+type PatchSetFile struct {
+	File       string `json:"file"`
+	Type       string `json:"type"`
+	Insertions int    `json:"insertions"`
+	Deletions  int    `json:"deletions"`
 }
 
 type Change struct {
@@ -48,6 +64,44 @@ type Change struct {
 	Hashtags             []string `json:"hashtags,omitempty"`
 }
 
+// QueriedChange is a change as written by `gerrit query --format=JSON`
+type QueriedChange struct {
+	Change
+	Open            bool       `json:"open"`
+	CurrentPatchSet *PatchSet  `json:"currentPatchSet,omitempty"`
+	PatchSets       []PatchSet `json:"patchSets,omitempty"`
+	// Type is "stats" on the summary line which ends the query output and "error" when the query failed
+	Type string `json:"type,omitempty"`
+	// Message is the reason a query failed
+	Message string `json:"message,omitempty"`
+}
+
+// GetPatchSet returns a patch set of the change by number
+func (c *QueriedChange) GetPatchSet(number int) (*PatchSet, bool) {
+	if c.CurrentPatchSet != nil && c.CurrentPatchSet.Number == number {
+		return c.CurrentPatchSet, true
+	}
+	for i := range c.PatchSets {
+		if c.PatchSets[i].Number == number {
+			return &c.PatchSets[i], true
+		}
+	}
+	return nil, false
+}
+
+// GetPatchSetByRevision returns a patch set of the change by commit
+func (c *QueriedChange) GetPatchSetByRevision(revision string) (*PatchSet, bool) {
+	if c.CurrentPatchSet != nil && c.CurrentPatchSet.Revision == revision {
+		return c.CurrentPatchSet, true
+	}
+	for i := range c.PatchSets {
+		if c.PatchSets[i].Revision == revision {
+			return &c.PatchSets[i], true
+		}
+	}
+	return nil, false
+}
+
 type ChangeKey struct {
 	ID string `json:"id"`
 }
@@ -61,37 +115,65 @@ type RefUpdate struct {
 
 // Event represents a Gerrit event.
 type Event struct {
-	Abandoner *User `json:"abandoner,omitempty"`
-	// Author         *User      `json:"author"`
-	Uploader       *User      `json:"uploader"`
-	Reviewer       *User      `json:"reviewer"`
-	Adder          *User      `json:"adder"`
-	Remover        *User      `json:"remover"`
-	Submitter      *User      `json:"submitter,omitempty"`
-	NewRev         string     `json:"newRev,omitempty"`
-	Ref            string     `json:"ref,omitempty"`
-	TargetNode     string     `json:"targetNode,omitempty"`
-	TargetUri      string     `json:"targetUri,omitempty"`
-	Approvals      []Approval `json:"approvals,omitempty"`
-	Comment        string     `json:"comment,omitempty"`
-	PatchSet       PatchSet   `json:"patchSet"`
-	Change         Change     `json:"change"`
-	Project        string     `json:"project"`
-	RefName        string     `json:"refName"`
-	ChangeKey      ChangeKey  `json:"changeKey"`
-	RefUpdate      RefUpdate  `json:"refUpdate"`
-	Type           string     `json:"type"`
-	Reason         string     `json:"reason,omitempty"`
-	EventCreatedOn int        `json:"eventCreatedOn"`
-	Status         string     `json:"status,omitempty"`
-	RefStatus      string     `json:"refStatus,omitempty"`
-	NodesCount     int        `json:"nodesCount,omitempty"`
-	OldTopic       string     `json:"oldTopic,omitempty"`
-	Changer        *User      `json:"changer,omitempty"`
-	Editor         *User      `json:"editor,omitempty"`
-	Restorer       *User      `json:"restorer,omitempty"`
-	OldAssignee    *User      `json:"oldAssignee,omitempty"`
-	Added          []string   `json:"added,omitempty"`
-	Removed        []string   `json:"removed,omitempty"`
-	Hashtags       []string   `json:"hashtags,omitempty"`
+	Abandoner  *User      `json:"abandoner,omitempty"`
+	Author     *User      `json:"author,omitempty"`
+	Uploader   *User      `json:"uploader"`
+	Reviewer   *User      `json:"reviewer"`
+	Adder      *User      `json:"adder"`
+	Remover    *User      `json:"remover"`
+	Submitter  *User      `json:"submitter,omitempty"`
+	NewRev     string     `json:"newRev,omitempty"`
+	Ref        string     `json:"ref,omitempty"`
+	TargetNode string     `json:"targetNode,omitempty"`
+	TargetUri  string     `json:"targetUri,omitempty"`
+	Approvals  []Approval `json:"approvals,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	// Tag of a comment. Ex: autogenerated:buildkite
+	Tag            string    `json:"tag,omitempty"`
+	PatchSet       PatchSet  `json:"patchSet"`
+	Change         Change    `json:"change"`
+	Project        string    `json:"project"`
+	RefName        string    `json:"refName"`
+	ChangeKey      ChangeKey `json:"changeKey"`
+	RefUpdate      RefUpdate `json:"refUpdate"`
+	Type           string    `json:"type"`
+	Reason         string    `json:"reason,omitempty"`
+	EventCreatedOn int       `json:"eventCreatedOn"`
+	Status         string    `json:"status,omitempty"`
+	RefStatus      string    `json:"refStatus,omitempty"`
+	NodesCount     int       `json:"nodesCount,omitempty"`
+	OldTopic       string    `json:"oldTopic,omitempty"`
+	Changer        *User     `json:"changer,omitempty"`
+	Editor         *User     `json:"editor,omitempty"`
+	Restorer       *User     `json:"restorer,omitempty"`
+	OldAssignee    *User     `json:"oldAssignee,omitempty"`
+	Added          []string  `json:"added,omitempty"`
+	Removed        []string  `json:"removed,omitempty"`
+	Hashtags       []string  `json:"hashtags,omitempty"`
+
+	// ctx carries the trace of the event through its handlers
+	ctx context.Context
+}
+
+// Context returns the context of the event. It is never nil.
+func (e Event) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// WithContext returns a copy of the event with ctx as its context
+func (e Event) WithContext(ctx context.Context) Event {
+	e.ctx = ctx
+	return e
+}
+
+// TraceID returns the ID of the trace the event belongs to or an empty string when it is not traced
+func (e Event) TraceID() string {
+	spanContext := trace.SpanContextFromContext(e.Context())
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
 }
@@ -1,73 +1,97 @@
 package main
 
 import (
-	"context"
-	"regexp"
+	"fmt"
 
 	"github.com/buildkite/go-buildkite/buildkite"
 	"github.com/mrmod/gerrit-buildkite/backend"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	eventRouter = map[string][]EventHandlerFunc{
-		"patchset-created": {},
-		"ref-updated":      {},
-		"comment-added":    {},
-	}
-	commentCommands = map[*regexp.Regexp]commandFunc{
-		regexp.MustCompile(`(?mi)^retest$`): handleRetestComment,
+		"patchset-created":  {},
+		"ref-updated":       {},
+		"comment-added":     {},
+		"change-merged":     {},
+		"change-abandoned":  {},
+		"change-deleted":    {},
+		"change-restored":   {},
+		"wip-state-changed": {},
+		"hashtags-changed":  {},
+		"topic-changed":     {},
 	}
+	// gerritClient lets handlers read from and write back to Gerrit
+	gerritClient GerritClient
 )
 
-type commandFunc func(event Event, p BuildPipeline, b backend.Backend) error
-
 type EventHandlerFunc func(Event, BuildPipeline, backend.Backend) error
 
-func createAndSaveBuild(p BuildPipeline, b backend.Backend, event Event, build *buildkite.CreateBuild) error {
+// createTracedBuild creates a build for an event and continues the trace of the event in its meta-data
+func createTracedBuild(p BuildPipeline, event Event, build *buildkite.CreateBuild) (int, error) {
+	ctx, span := tracer.Start(event.Context(), "buildkite.create_build", trace.WithAttributes(eventAttributes(event)...))
+	if build.MetaData == nil {
+		build.MetaData = map[string]string{}
+	}
+	// The webhook handler continues the trace from the build meta-data
+	injectTraceContext(ctx, build.MetaData)
 	buildNumber, err := p.CreateBuild(build)
+	span.SetAttributes(attribute.Int("buildkite.build_number", buildNumber))
+	endSpan(span, err)
 	if err != nil {
 		log.Error().Err(err).
 			Str("eventType", event.Type).
 			Int("patch", event.PatchSet.Number).
 			Int("change", event.Change.Number).
+			Str("traceId", event.TraceID()).
 			Msg("Failed to create build")
-		return err
+	}
+	return buildNumber, err
+}
+
+// saveBuild saves a build created for an event to the backend
+func saveBuild(b backend.Backend, event Event, pb *backend.PatchBuild) error {
+	log.Debug().
+		Str("eventType", event.Type).
+		Int("patch", pb.Patch.Number).
+		Int("change", pb.Patch.Change).
+		Int("buildNumber", pb.BuildNumber).
+		Str("traceId", event.TraceID()).
+		Msg("Saving patch build information")
+	ctx, span := tracer.Start(event.Context(), "backend.save_build", trace.WithAttributes(attribute.Int("buildkite.build_number", pb.BuildNumber)))
+	err := b.SaveBuild(ctx, pb)
+	endSpan(span, err)
+	return err
+}
+
+// createAndSaveBuild creates a build of the patch set of an event and saves it to the backend
+func createAndSaveBuild(p BuildPipeline, b backend.Backend, event Event, build *buildkite.CreateBuild) (*backend.PatchBuild, error) {
+	if build.MetaData == nil {
+		build.MetaData = map[string]string{}
+	}
+	tagBuildPatch(build.MetaData, &backend.PatchBuild{
+		Patch: &backend.Patch{Number: event.PatchSet.Number, Change: event.Change.Number},
+	}, event.Change.Project)
+	buildNumber, err := createTracedBuild(p, event, build)
+	if err != nil {
+		return nil, err
 	}
 	pb := &backend.PatchBuild{
 		BuildNumber: buildNumber,
+		Pipeline:    p.Slug(),
+		State:       "scheduled",
 		Patch: &backend.Patch{
 			Number: event.PatchSet.Number,
 			Change: event.Change.Number,
 		},
 	}
-	ctx := context.TODO()
-	log.Debug().
-		Str("eventType", event.Type).
-		Int("patch", event.PatchSet.Number).
-		Int("change", event.Change.Number).
-		Int("buildNumber", buildNumber).
-		Msg("Saving patch build information")
-	return b.SaveBuild(ctx, pb)
+	return pb, saveBuild(b, event, pb)
 }
 
-func handleRetestComment(event Event, p BuildPipeline, b backend.Backend) error {
-	log.Info().
-		Str("eventType", event.Type).
-		Int("patch", event.PatchSet.Number).
-		Int("change", event.Change.Number).
-		Msg("Retesting patchset")
-	patch := &backend.Patch{
-		Number:   event.PatchSet.Number,
-		Change:   event.Change.Number,
-		Revision: event.PatchSet.Revision,
-	}
-	log.Debug().
-		Str("eventType", event.Type).
-		Str("patchRevision", patch.Revision).
-		Int("change", patch.Change).
-		Int("patchNumber", patch.Number).
-		Msg("Creating build")
+// newCreateBuild describes a Buildkite build of the patch set of an event with the configured message, env and meta-data
+func newCreateBuild(event Event) *buildkite.CreateBuild {
 	build := &buildkite.CreateBuild{
 		Commit: event.PatchSet.Revision,
 		Branch: event.Change.ID,
@@ -75,21 +99,46 @@ func handleRetestComment(event Event, p BuildPipeline, b backend.Backend) error
 			Name:  event.PatchSet.Author.Name,
 			Email: event.PatchSet.Author.Email,
 		},
+		Env:      renderBuildTemplates("env", config.Build.Env, event),
+		MetaData: renderBuildTemplates("meta_data", config.Build.MetaData, event),
 	}
-	return createAndSaveBuild(p, b, event, build)
+	if config.Build.Message != "" {
+		message, err := renderBuildTemplate("message", config.Build.Message, event)
+		if err != nil {
+			log.Error().Err(err).Int("change", event.Change.Number).Msg("Failed to render build message")
+		}
+		build.Message = message
+	}
+	return build
 }
 
 func HandleCommentAdded(event Event, p BuildPipeline, b backend.Backend) error {
-	comment := event.Comment
-
-	for expression, cmdFunc := range commentCommands {
-		log.Debug().Str("comment", comment).Msg("Checking comment for command")
-		if expression.MatchString(comment) {
-			return cmdFunc(event, p, b)
-		}
+	if reason, ignored := commentIgnored(event); ignored {
+		log.Debug().
+			Int("change", event.Change.Number).
+			Str("reason", reason).
+			Msg("Ignoring comment")
+		return nil
+	}
+	log.Debug().Str("comment", event.Comment).Msg("Checking comment for command")
+	invocation, ok := findCommandInvocation(event.Comment, config.Commands.Prefixes)
+	if !ok {
+		log.Debug().Msg("No command found in comment")
+		return nil
+	}
+	allowed, err := commandAllowed(invocation.Command, event.Author, gerritClient)
+	if err != nil {
+		return err
 	}
-	log.Debug().Msg("No command found in comment")
-	return nil
+	if !allowed {
+		log.Warn().
+			Str("command", invocation.Command.Name).
+			Int("change", event.Change.Number).
+			Any("author", event.Author).
+			Msg("Comment command not allowed")
+		return replyToComment(event, fmt.Sprintf("You are not allowed to run %s", invocation.Command.Name))
+	}
+	return invocation.Command.Run(event, invocation.Args, p, b)
 }
 
 func HandlePatchsetCreated(event Event, p BuildPipeline, b backend.Backend) error {
@@ -116,68 +165,19 @@ func HandlePatchsetCreated(event Event, p BuildPipeline, b backend.Backend) erro
 		Revision: event.PatchSet.Revision,
 	}
 
-	// Cancel previous build if it exists
-	if patch.Number > 1 {
-		prevPatch := &backend.Patch{
-			Number: patch.Number - 1,
-			Change: patch.Change,
-		}
-		if pb, err := b.GetPatch(context.TODO(), prevPatch); err == nil {
-			log.Debug().
-				Str("eventType", event.Type).
-				Str("eventType", event.Type).
-				Int("patch", patch.Number).
-				Int("change", patch.Change).
-				Int("prevPatch", prevPatch.Number).
-				Msg("Cancelling previous build")
-			if err := p.CancelBuild(pb.BuildNumber); err != nil {
-				log.Error().
-					Err(err).
-					Str("eventType", event.Type).
-					Int("patch", patch.Number).
-					Int("change", patch.Change).
-					Int("prevPatch", prevPatch.Number).
-					Msg("Failed to cancel build")
-			}
-		}
+	// Results of older patch sets are stale from now on
+	recordCurrentPatch(event, b)
+
+	// The result of the previous patch set still holds for trivial changes
+	if carried, err := carryForwardBuild(event, b); carried || err != nil {
+		return err
 	}
+
 	log.Debug().
 		Str("eventType", event.Type).
 		Str("patchRevision", patch.Revision).
 		Int("change", patch.Change).
 		Int("patchNumber", patch.Number).
 		Msg("Creating build")
-	build := &buildkite.CreateBuild{
-		Commit: event.PatchSet.Revision,
-		Branch: event.Change.ID,
-		Author: buildkite.Author{
-			Name:  event.PatchSet.Author.Name,
-			Email: event.PatchSet.Author.Email,
-		},
-	}
-	return createAndSaveBuild(p, b, event, build)
-}
-
-func HandleRefUpdated(event Event, p BuildPipeline, b backend.Backend) error {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Error().
-				Any("panic", err).
-				Str("handler", "HandleRefUpdated").
-				Msg("Panic recovered")
-		}
-	}()
-	log.Debug().
-		Str("eventType", event.Type).
-		Int("patch", event.PatchSet.Number).
-		Int("change", event.Change.Number).
-		Str("refName", event.RefUpdate.RefName).Msg("Ref updated")
-	if ok, _ := regexp.MatchString(`^refs/heads/(master|main)`, event.RefUpdate.RefName); ok {
-		log.Info().
-			Str("eventType", event.Type).
-			Int("patch", event.PatchSet.Number).
-			Int("change", event.Change.Number).
-			Msg("Trunk Updated")
-	}
-	return nil
+	return createChangeBuild(event, p, b)
 }
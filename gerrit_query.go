@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errPatchSetNotFound = errors.New("patch set not found")
+
+// queryPatchSetEvent finds a patch set of a change in Gerrit and describes it as an event of eventType
+// so it can be handled like one received from the event stream
+func queryPatchSetEvent(gerrit GerritChangeQuerier, eventType string, change, patch int) (Event, error) {
+	changes, err := gerrit.QueryChanges(fmt.Sprintf("change:%d", change))
+	if err != nil {
+		return Event{}, err
+	}
+	for _, c := range changes {
+		if c.Number != change {
+			continue
+		}
+		patchSet, ok := c.GetPatchSet(patch)
+		if !ok {
+			break
+		}
+		return Event{
+			Type:     eventType,
+			Change:   c.Change,
+			PatchSet: *patchSet,
+			Project:  c.Project,
+		}, nil
+	}
+	return Event{}, fmt.Errorf("%w: change %d patch set %d", errPatchSetNotFound, change, patch)
+}
@@ -9,6 +9,8 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mrmod/gerrit-buildkite/backend"
 	"github.com/rs/zerolog/log"
@@ -20,6 +22,11 @@ const (
 	ReviewStateRejected   = -1
 )
 
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
 var (
 	sshConnectionOptions = []string{
 		"-o ServerAliveInterval=10",
@@ -49,6 +56,8 @@ type GitSSHRemote struct {
 // GerritSSHClient represents a Gerrit server
 type GerritSSHClient struct {
 	GitSSHRemote
+	// Stream is the state of the event stream opened by Listen
+	Stream *StreamState
 }
 
 // GerritEventListener is an interface for listening to Gerrit events
@@ -67,12 +76,113 @@ type GerritReviewWriter interface {
 	SetReviewState(*Review) error
 }
 
+// GerritChangeQuerier is an interface for finding changes in Gerrit
+type GerritChangeQuerier interface {
+	QueryChanges(query string, options ...string) ([]QueriedChange, error)
+}
+
+// QueryFiles is a QueryChanges option which adds the files of each patch set
+const QueryFiles = "--files"
+
+// GerritGroupLister is an interface for listing the members of Gerrit groups
+type GerritGroupLister interface {
+	ListGroupMembers(group string) ([]User, error)
+}
+
+// GerritClient is what event handlers need from Gerrit
+type GerritClient interface {
+	GerritReviewWriter
+	GerritChangeQuerier
+	GerritGroupLister
+}
+
+// reviewTag marks the reviews of the bridge so they are not mistaken for comments by people
+const reviewTag = "autogenerated:buildkite"
+
 // Review represents a Gerrit review
 type Review struct {
 	*backend.Patch
-	State              int
-	Message            string
+	State   int
+	Message string
+	// OmitVote posts the message without changing the vote
+	OmitVote bool
+	// Notify is who is emailed about the review: NONE, OWNER, OWNER_REVIEWERS or ALL. Empty is NONE
+	Notify string
+	// NotifyDetails are accounts or emails notified whatever Notify is, by recipient type: TO, CC or BCC
+	NotifyDetails map[string][]string
+	// NotifyEmailAddress is notified as a TO recipient
 	NotifyEmailAddress string
+	// AddToAttentionSet and RemoveFromAttentionSet change who is expected to act on the change
+	AddToAttentionSet      []AttentionSetInput
+	RemoveFromAttentionSet []AttentionSetInput
+	// Reviewers are accounts or groups added as reviewers
+	Reviewers []string
+}
+
+// ReviewInput is the review read by `gerrit review --json`, as in the Gerrit REST API
+type ReviewInput struct {
+	Message       string                `json:"message"`
+	Tag           string                `json:"tag"`
+	Labels        map[string]int        `json:"labels,omitempty"`
+	Notify        string                `json:"notify"`
+	NotifyDetails map[string]NotifyInfo `json:"notify_details,omitempty"`
+
+	AddToAttentionSet      []AttentionSetInput `json:"add_to_attention_set,omitempty"`
+	RemoveFromAttentionSet []AttentionSetInput `json:"remove_from_attention_set,omitempty"`
+	Reviewers              []ReviewerInput     `json:"reviewers,omitempty"`
+}
+
+// AttentionSetInput is an account added to or removed from the attention set and why
+type AttentionSetInput struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+}
+
+// ReviewerInput is an account or group added as a reviewer
+type ReviewerInput struct {
+	Reviewer string `json:"reviewer"`
+}
+
+// NotifyInfo are the accounts of a recipient type, by username, email or account id
+type NotifyInfo struct {
+	Accounts []string `json:"accounts"`
+}
+
+// reviewInput is the ReviewInput of a review
+func reviewInput(r *Review) ReviewInput {
+	input := ReviewInput{
+		Message:                r.Message,
+		Tag:                    reviewTag,
+		Notify:                 r.Notify,
+		AddToAttentionSet:      r.AddToAttentionSet,
+		RemoveFromAttentionSet: r.RemoveFromAttentionSet,
+	}
+	for _, reviewer := range r.Reviewers {
+		input.Reviewers = append(input.Reviewers, ReviewerInput{Reviewer: reviewer})
+	}
+	if input.Notify == "" {
+		input.Notify = NotifyNone
+	}
+	if !r.OmitVote {
+		input.Labels = map[string]int{"Code-Review": r.State}
+	}
+	details := map[string][]string{}
+	for recipient, accounts := range r.NotifyDetails {
+		details[recipient] = append(details[recipient], accounts...)
+	}
+	if r.NotifyEmailAddress != "" {
+		details["TO"] = append(details["TO"], r.NotifyEmailAddress)
+	}
+	for recipient, accounts := range details {
+		if len(accounts) == 0 {
+			continue
+		}
+		if input.NotifyDetails == nil {
+			input.NotifyDetails = map[string]NotifyInfo{}
+		}
+		input.NotifyDetails[recipient] = NotifyInfo{Accounts: accounts}
+	}
+	return input
 }
 
 func NewGerritSSHClient(sshUrl string, sshKeyPath string) (*GerritSSHClient, error) {
@@ -88,7 +198,10 @@ func NewGerritSSHClient(sshUrl string, sshKeyPath string) (*GerritSSHClient, err
 		URL:        u,
 		SshKeyPath: _sshKeyPath,
 	}
-	return &GerritSSHClient{sshClient}, nil
+	return &GerritSSHClient{
+		GitSSHRemote: sshClient,
+		Stream:       NewStreamState(),
+	}, nil
 }
 
 // Build the command arguemtns for an ssh connection to Gerrit
@@ -107,25 +220,124 @@ func (s *GerritSSHClient) buildSshCommand() []string {
 	}
 }
 
-// SetReviewState sets the verified state of a review in Gerrit
+// SetReviewState sets the verified state of a review in Gerrit.
+// The review is written as JSON to `gerrit review --json` so the message needs no quoting.
 func (s *GerritSSHClient) SetReviewState(r *Review) error {
-
-	args := s.buildSshCommand()
-	reviewArgs := []string{
+	input, err := json.Marshal(reviewInput(r))
+	if err != nil {
+		return err
+	}
+	args := append(s.buildSshCommand(),
 		"review",
-		"-m", fmt.Sprintf(`'%s'`, r.Message),
-		"-n", "NONE",
-		"--code-review", fmt.Sprint(r.State),
+		"--json",
 		fmt.Sprintf("%d,%d", r.Patch.Change, r.Patch.Number),
-	}
+	)
 	log.Debug().
 		Str("patchNumber", fmt.Sprint(r.Patch.Number)).
 		Int("change", r.Patch.Change).
 		Int("state", r.State).
-		Str("_args", strings.Join(append(args, reviewArgs...), " ")).
+		Str("_args", strings.Join(args, " ")).
+		RawJSON("reviewInput", input).
 		Msgf("Setting review state: %d", r.State)
 
-	return exec.Command("ssh", append(args, reviewArgs...)...).Run()
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = bytes.NewReader(input)
+	err = cmd.Run()
+	metricReviewPosts.WithLabelValues(resultLabel(err)).Inc()
+	return err
+}
+
+// QueryChanges returns the changes matching a Gerrit search query with their patch sets
+// Ex: change:12 or topic:my-topic status:open
+// options add more to each change. Ex: QueryFiles
+func (s *GerritSSHClient) QueryChanges(query string, options ...string) ([]QueriedChange, error) {
+	args := append(s.buildSshCommand(),
+		"query",
+		"--format=JSON",
+		"--current-patch-set",
+		"--patch-sets",
+	)
+	args = append(args, options...)
+	args = append(args, shellQuote(query))
+	log.Debug().
+		Str("query", query).
+		Str("_args", strings.Join(args, " ")).
+		Msg("Querying changes")
+	output, err := exec.Command("ssh", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseQueryOutput(output)
+}
+
+// shellQuote quotes an argument of a command run by the remote shell of the Gerrit ssh daemon
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// ListGroupMembers returns the accounts in a Gerrit group and its included groups
+func (s *GerritSSHClient) ListGroupMembers(group string) ([]User, error) {
+	args := append(s.buildSshCommand(),
+		"ls-members",
+		"--recursive",
+		shellQuote(group),
+	)
+	log.Debug().
+		Str("group", group).
+		Str("_args", strings.Join(args, " ")).
+		Msg("Listing group members")
+	output, err := exec.Command("ssh", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseMembersOutput(output)
+}
+
+// parseMembersOutput decodes the tab separated table written by `gerrit ls-members`
+// Ex: id\tusername\tfull name\temail
+func parseMembersOutput(output []byte) ([]User, error) {
+	members := []User{}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	for i, line := range lines {
+		// The first line is the header
+		if i == 0 || line == "" {
+			continue
+		}
+		columns := strings.Split(line, "\t")
+		if len(columns) != 4 {
+			return nil, fmt.Errorf("unexpected ls-members line %q", line)
+		}
+		member := User{Username: columns[1], Name: columns[2], Email: columns[3]}
+		// Missing values are written as n/a
+		if member.Username == "n/a" {
+			member.Username = ""
+		}
+		if member.Email == "n/a" {
+			member.Email = ""
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// parseQueryOutput decodes the JSON lines written by `gerrit query --format=JSON`
+func parseQueryOutput(output []byte) ([]QueriedChange, error) {
+	changes := []QueriedChange{}
+	decoder := json.NewDecoder(bytes.NewBuffer(output))
+	for decoder.More() {
+		change := QueriedChange{}
+		if err := decoder.Decode(&change); err != nil {
+			return nil, err
+		}
+		switch change.Type {
+		case "stats":
+			continue
+		case "error":
+			return nil, fmt.Errorf("gerrit query failed: %s", change.Message)
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
 }
 
 // GetListener returns a new unopened SSH connection to Gerrit.
@@ -140,21 +352,33 @@ func (s *GerritSSHClient) getListener() *exec.Cmd {
 }
 
 // Listen listens for events on the Gerrit ssh event stream
+// and reconnects with a backoff when the connection closes
 func (s *GerritSSHClient) Listen(events chan<- Event) {
-	listener := s.getListener()
-	eventStream, err := listener.StdoutPipe()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to open SSH connection to Gerrit")
-		return
-	}
-	log.Debug().Msg("Starting SSH connection to Gerrit")
-
-	for {
+	defer s.Stream.setStopped()
+	retryDelay := minReconnectDelay
+	for connection := 0; ; connection++ {
+		if connection > 0 {
+			log.Info().
+				Int("connection", connection).
+				Dur("retryDelay", retryDelay).
+				Msg("Reconnecting to Gerrit")
+			time.Sleep(retryDelay)
+			retryDelay = min(retryDelay*2, maxReconnectDelay)
+			metricSSHReconnects.Inc()
+		}
+		listener := s.getListener()
+		eventStream, err := listener.StdoutPipe()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to open SSH connection to Gerrit")
+			return
+		}
+		log.Debug().Msg("Starting SSH connection to Gerrit")
 
 		if err := listener.Start(); err != nil {
 			log.Error().Err(err).Msg("Failed to start SSH connection to Gerrit")
-			return
+			continue
 		}
+		s.Stream.setConnected(true)
 
 		scanner := bufio.NewScanner(eventStream)
 		maxBufferSize := 1024 * 1024
@@ -167,35 +391,56 @@ func (s *GerritSSHClient) Listen(events chan<- Event) {
 			decoder := json.NewDecoder(bytes.NewBufferString(scanner.Text()))
 			event := Event{}
 			if err := decoder.Decode(&event); err != nil {
-				log.Error().Err(err).Msg("Failed to decode Gerrit event")
-				return
+				log.Error().Err(err).Str("event", text).Msg("Failed to decode Gerrit event")
+				continue
 			}
+			s.Stream.eventReceived()
+			// Events are flowing so the next reconnect can be quick
+			retryDelay = minReconnectDelay
+			metricEventsReceived.WithLabelValues(event.Type).Inc()
 			log.Debug().Str("eventType", event.Type).Msgf("Dispatching received event %s", event.Type)
 			events <- event
 		}
+		if err := scanner.Err(); err != nil {
+			log.Err(err).Msg("Failed to read from SSH connection to Gerrit")
+		}
 		log.Debug().Msg("Closing SSH connection to Gerrit")
+		s.Stream.setConnected(false)
 
 		if err := listener.Wait(); err != nil {
-			log.Err(err).Msg("Failed to wait for SSH connection to Gerrit")
-			return
+			log.Err(err).Msg("SSH connection to Gerrit closed with an error")
 		}
 	}
-
 }
 
 // Handle dispatches events to the appropriate handler
 func (s *GerritSSHClient) Handle(events chan Event, p BuildPipeline, b backend.Backend) {
 	for event := range events {
 		if handlers, ok := eventRouter[event.Type]; ok {
+			event, span := startEventSpan(event)
+			event = recentEvents.Add(event)
 			log.Trace().Any("event", event).Msg("Raw Event from Dispatch")
-			log.Debug().Str("eventType", event.Type).Msgf("Handling dispatched event %s", event.Type)
+			log.Debug().
+				Str("eventType", event.Type).
+				Str("traceId", event.TraceID()).
+				Msgf("Handling dispatched event %s", event.Type)
+			wg := &sync.WaitGroup{}
 			for i, handler := range handlers {
 				log.Trace().
 					Int("handlerId", i).
 					Str("eventType", event.Type).
 					Msg("Dispatching event to handler")
-				go handler(event, p, b)
+				wg.Add(1)
+				go func(handler EventHandlerFunc) {
+					defer wg.Done()
+					handler(event, p, b)
+				}(handler)
 			}
+			// The event span ends once every handler has returned
+			go func() {
+				wg.Wait()
+				span.End()
+			}()
 			continue
 		}
 		log.Info().Str("eventType", event.Type).Msgf("No handler for event %s", event.Type)
@@ -40,11 +40,12 @@ func TestItSavesBuildWhenAPatchsetIsCreated(t *testing.T) {
 func TestItCancelsThePreviousPatchSet(t *testing.T) {
 	p := NewMockPipeline()
 	b := NewMockBackend()
-	b.MockGetPatch = func(ctx context.Context, patch *backend.Patch) (*backend.PatchBuild, error) {
-		return &backend.PatchBuild{
+	b.MockGetChangeBuilds = func(ctx context.Context, change int) ([]*backend.PatchBuild, error) {
+		return []*backend.PatchBuild{{
 			BuildNumber: 123,
-			Patch:       patch,
-		}, nil
+			State:       "running",
+			Patch:       &backend.Patch{Number: 1, Change: change},
+		}}, nil
 	}
 	event := Event{
 		Type: "patchset-created",
@@ -71,3 +72,49 @@ func TestItCancelsThePreviousPatchSet(t *testing.T) {
 		t.Errorf("Expected CancelBuild to be called once, but it was called %d times", p.FunctionCallCounter["CancelBuild"])
 	}
 }
+
+func TestItCancelsEverySupersededBuild(t *testing.T) {
+	p := NewMockPipeline()
+	cancelled := []int{}
+	p.MockCancelBuild = func(buildNumber int) (CancelResult, error) {
+		cancelled = append(cancelled, buildNumber)
+		return CancelResultCancelled, nil
+	}
+	// Build 2 finished since its last webhook
+	p.MockGetBuild = func(buildNumber int) (*Build, error) {
+		if buildNumber == 2 {
+			return &Build{Number: buildNumber, State: "passed"}, nil
+		}
+		return &Build{Number: buildNumber, State: "running"}, nil
+	}
+	b := NewMockBackend()
+	b.MockGetChangeBuilds = func(ctx context.Context, change int) ([]*backend.PatchBuild, error) {
+		return []*backend.PatchBuild{
+			{BuildNumber: 1, State: "running", Patch: &backend.Patch{Number: 1, Change: change}},
+			{BuildNumber: 2, State: "running", Patch: &backend.Patch{Number: 2, Change: change}},
+			{BuildNumber: 3, State: "failed", Patch: &backend.Patch{Number: 3, Change: change}},
+			{BuildNumber: 4, State: "scheduled", Patch: &backend.Patch{Number: 4, Change: change}},
+			// Other changes of the topic share build 5
+			{BuildNumber: 5, State: "running", Trigger: backend.TriggerTopic, Patch: &backend.Patch{Number: 5, Change: change}},
+		}, nil
+	}
+	savedStates := map[int]string{}
+	b.MockSaveBuildState = func(ctx context.Context, pipeline string, buildNumber int, state string) error {
+		savedStates[buildNumber] = state
+		return nil
+	}
+	event := Event{
+		Type:     "patchset-created",
+		PatchSet: PatchSet{Number: 6},
+		Change:   Change{Number: 9999},
+	}
+	if err := HandlePatchsetCreated(event, p, b); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if len(cancelled) != 2 || cancelled[0] != 1 || cancelled[1] != 4 {
+		t.Errorf("Expected builds 1 and 4 to be cancelled, but cancelled %v", cancelled)
+	}
+	if savedStates[2] != "passed" {
+		t.Errorf("Expected the Buildkite state of build 2 to be saved, but got %v", savedStates)
+	}
+}
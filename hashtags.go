@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// HashtagsConfig controls the builds of a change by its hashtags. The topic of a change counts as one more hashtag,
+// so a topic named like a skip hashtag stops builds and moving a change to a topic named like a pipelines or build hashtag builds it.
+//
+//	hashtags:
+//	  skip: [skip-ci]
+//	  pipelines:
+//	    full-ci: full
+//	  build: [run-ci]
+type HashtagsConfig struct {
+	// Skip hashtags stop the automatic builds of a change. Comment commands and votes still build
+	Skip []string `yaml:"skip"`
+	// Pipelines choose the pipeline of a change by hashtag. Adding one builds the current patch set on it
+	Pipelines map[string]string `yaml:"pipelines"`
+	// Build hashtags build the current patch set on the pipeline chosen by the other hashtags when added
+	Build []string `yaml:"build"`
+}
+
+func defaultHashtagsConfig() HashtagsConfig {
+	return HashtagsConfig{
+		Skip:      []string{"skip-ci"},
+		Pipelines: map[string]string{},
+		Build:     []string{},
+	}
+}
+
+// Validate checks hashtags choose known pipelines
+func (c HashtagsConfig) Validate(pipelines map[string]string) error {
+	for hashtag, pipeline := range c.Pipelines {
+		if _, ok := pipelines[pipeline]; !ok {
+			return fmt.Errorf("hashtags.pipelines.%s uses unknown pipeline %q", hashtag, pipeline)
+		}
+	}
+	return nil
+}
+
+// changeHashtags are the hashtags and the topic of a change
+func changeHashtags(change Change) []string {
+	hashtags := slices.Clone(change.Hashtags)
+	if change.Topic != "" {
+		hashtags = append(hashtags, change.Topic)
+	}
+	return hashtags
+}
+
+// Skips returns the hashtag which stops the automatic builds of a change
+func (c HashtagsConfig) Skips(change Change) (string, bool) {
+	for _, hashtag := range changeHashtags(change) {
+		if slices.Contains(c.Skip, hashtag) {
+			return hashtag, true
+		}
+	}
+	return "", false
+}
+
+// PipelineOf returns the name of the pipeline chosen by the first hashtag of a change with one.
+// It is empty for the default pipeline.
+func (c HashtagsConfig) PipelineOf(change Change) string {
+	for _, hashtag := range changeHashtags(change) {
+		if pipeline, ok := c.Pipelines[hashtag]; ok {
+			return pipeline
+		}
+	}
+	return ""
+}
+
+// Builds checks adding a hashtag builds the change and returns the name of its pipeline
+func (c HashtagsConfig) Builds(hashtag string) (string, bool) {
+	if pipeline, ok := c.Pipelines[hashtag]; ok {
+		return pipeline, true
+	}
+	return "", slices.Contains(c.Build, hashtag)
+}
+
+// buildSkipped checks a hashtag stops the automatic builds of the change of an event
+func buildSkipped(event Event) bool {
+	hashtag, skipped := config.Hashtags.Skips(event.Change)
+	if skipped {
+		log.Info().
+			Str("eventType", event.Type).
+			Int("change", event.Change.Number).
+			Int("patch", event.PatchSet.Number).
+			Str("hashtag", hashtag).
+			Msg("Skipping build of change")
+	}
+	return skipped
+}
+
+// createChangeBuild cancels the unfinished builds of earlier patch sets of the change of an event
+// and builds its patch set on the pipeline chosen by its hashtags unless a hashtag skips it
+func createChangeBuild(event Event, p BuildPipeline, b backend.Backend) error {
+	if err := cancelSupersededBuilds(event, p, b); err != nil {
+		log.Error().
+			Err(err).
+			Str("eventType", event.Type).
+			Int("patch", event.PatchSet.Number).
+			Int("change", event.Change.Number).
+			Msg("Failed to cancel superseded builds")
+	}
+	if buildSkipped(event) {
+		return nil
+	}
+	return createPipelineBuild(event, "", p, b)
+}
+
+// createPipelineBuild builds the patch set of an event on a named pipeline, or the pipeline chosen by its hashtags when empty,
+// with the other open changes of its topic when topic builds are enabled and the changes it depends on when dependencies are enabled
+func createPipelineBuild(event Event, pipelineName string, p BuildPipeline, b backend.Backend) error {
+	chain, err := dependencyChain(event)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Int("change", event.Change.Number).
+			Int("patch", event.PatchSet.Number).
+			Msg("Failed to resolve the relation chain, building without it")
+	}
+	return createChainBuild(event, pipelineName, p, b, chain)
+}
+
+// withCurrentPatchSet returns the event with the change and current patch set from Gerrit.
+// Events about a change without a patch set, like hashtags-changed, need it to build.
+func withCurrentPatchSet(event Event) (Event, bool, error) {
+	changes, err := gerritClient.QueryChanges(fmt.Sprintf("change:%d", event.Change.Number))
+	if err != nil {
+		return event, false, err
+	}
+	for _, change := range changes {
+		if change.Number != event.Change.Number || change.CurrentPatchSet == nil {
+			continue
+		}
+		if !change.Open {
+			return event, false, nil
+		}
+		event.Change = change.Change
+		event.PatchSet = *change.CurrentPatchSet
+		return event, true, nil
+	}
+	return event, false, nil
+}
+
+// buildAddedHashtags builds the current patch set of a change once per pipeline chosen by the added hashtags
+func buildAddedHashtags(event Event, added []string, p BuildPipeline, b backend.Backend) error {
+	builds := slices.ContainsFunc(added, func(hashtag string) bool {
+		_, ok := config.Hashtags.Builds(hashtag)
+		return ok
+	})
+	if !builds {
+		return nil
+	}
+	event, open, err := withCurrentPatchSet(event)
+	if err != nil || !open {
+		return err
+	}
+	pipelineNames := []string{}
+	for _, hashtag := range added {
+		pipeline, ok := config.Hashtags.Builds(hashtag)
+		if pipeline == "" {
+			// Build hashtags use the pipeline chosen by the other hashtags
+			pipeline = config.Hashtags.PipelineOf(event.Change)
+		}
+		if ok && !slices.Contains(pipelineNames, pipeline) {
+			pipelineNames = append(pipelineNames, pipeline)
+		}
+	}
+	for _, name := range pipelineNames {
+		log.Info().
+			Str("eventType", event.Type).
+			Int("change", event.Change.Number).
+			Int("patch", event.PatchSet.Number).
+			Strs("added", added).
+			Str("pipeline", name).
+			Msg("Hashtag triggered build")
+		// A patch set already in a topic build is not built again
+		if err := createPipelineBuild(event, name, p, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleHashtagsChanged builds the current patch set when a hashtag which builds is added
+func HandleHashtagsChanged(event Event, p BuildPipeline, b backend.Backend) error {
+	return buildAddedHashtags(event, event.Added, p, b)
+}
+
+// HandleTopicChanged builds the current patch set when the change moves to a topic named like a hashtag which builds.
+// The topic counts as one more hashtag, see HashtagsConfig.
+func HandleTopicChanged(event Event, p BuildPipeline, b backend.Backend) error {
+	if event.Change.Topic == "" || event.Change.Topic == event.OldTopic {
+		return nil
+	}
+	return buildAddedHashtags(event, []string{event.Change.Topic}, p, b)
+}
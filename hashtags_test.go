@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func TestItSkipsBuildsOfChangesWithASkipHashtag(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	p := NewMockPipeline()
+	b := NewMockBackend()
+
+	for _, change := range []Change{
+		{Number: 42, Hashtags: []string{"skip-ci"}},
+		{Number: 42, Topic: "skip-ci"},
+	} {
+		event := Event{Type: "patchset-created", Change: change, PatchSet: PatchSet{Number: 2}}
+		if err := HandlePatchsetCreated(event, p, b); err != nil {
+			t.Fatal(err)
+		}
+		if err := HandleChangeRestored(event, p, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Errorf("Expected no builds, but CreateBuild was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+}
+
+func TestItChoosesThePipelineOfAHashtag(t *testing.T) {
+	full := NewMockPipeline()
+	full.MockSlug = "full-pipeline"
+	c := defaultConfig()
+	c.Pipelines = map[string]string{"full": "full-pipeline"}
+	c.Hashtags.Pipelines = map[string]string{"full-ci": "full"}
+	withConfig(t, c, map[string]BuildPipeline{"full": full})
+	p := NewMockPipeline()
+	b := NewMockBackend()
+
+	event := Event{Type: "patchset-created", Change: Change{Number: 42, Hashtags: []string{"docs", "full-ci"}}, PatchSet: PatchSet{Number: 2}}
+	if err := HandlePatchsetCreated(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if full.FunctionCallCounter["CreateBuild"] != 1 || p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Errorf("Expected the change to build on the full pipeline only")
+	}
+}
+
+func TestItBuildsWhenAHashtagIsAdded(t *testing.T) {
+	full := NewMockPipeline()
+	full.MockSlug = "full-pipeline"
+	c := defaultConfig()
+	c.Pipelines = map[string]string{"full": "full-pipeline"}
+	c.Hashtags.Pipelines = map[string]string{"full-ci": "full"}
+	c.Hashtags.Build = []string{"run-ci"}
+	var built *buildkite.CreateBuild
+	full.MockCreateBuild = func(build *buildkite.CreateBuild) (int, error) {
+		built = build
+		return 1, nil
+	}
+	withConfig(t, c, map[string]BuildPipeline{"full": full})
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	g := NewMockGerrit()
+	g.MockQueryChanges = func(query string, options ...string) ([]QueriedChange, error) {
+		if query != "change:42" {
+			t.Errorf("Unexpected query %q", query)
+		}
+		return []QueriedChange{{
+			Change:          Change{Number: 42, Project: "app", Hashtags: []string{"docs", "run-ci", "full-ci"}},
+			Open:            true,
+			CurrentPatchSet: &PatchSet{Number: 3, Revision: "abc123"},
+		}}, nil
+	}
+	withGerrit(t, g)
+
+	event := Event{Type: "hashtags-changed", Change: Change{Number: 42}, Added: []string{"docs", "run-ci", "full-ci"}}
+	if err := HandleHashtagsChanged(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	// run-ci builds on the full pipeline chosen by full-ci
+	if p.FunctionCallCounter["CreateBuild"] != 0 || full.FunctionCallCounter["CreateBuild"] != 1 {
+		t.Fatalf("Expected one build on the full pipeline only")
+	}
+	if built.Commit != "abc123" || built.MetaData["gerrit_patchset"] != "3" {
+		t.Errorf("Expected the current patch set to be built, but got %+v", built)
+	}
+
+	// Removing hashtags and adding others does not build
+	event = Event{Type: "hashtags-changed", Change: Change{Number: 42}, Added: []string{"docs"}, Removed: []string{"run-ci"}}
+	if err := HandleHashtagsChanged(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if g.FunctionCallCounter["QueryChanges"] != 1 {
+		t.Errorf("Expected Gerrit to be queried once, but it was queried %d times", g.FunctionCallCounter["QueryChanges"])
+	}
+}
+
+func TestItBuildsWhenTheTopicChanges(t *testing.T) {
+	c := defaultConfig()
+	c.Hashtags.Build = []string{"run-ci"}
+	withConfig(t, c, map[string]BuildPipeline{})
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	g := NewMockGerrit()
+	g.MockQueryChanges = func(query string, options ...string) ([]QueriedChange, error) {
+		return []QueriedChange{{Change: Change{Number: 42}, Open: false, CurrentPatchSet: &PatchSet{Number: 3}}}, nil
+	}
+	withGerrit(t, g)
+
+	// Closed changes are not built
+	event := Event{Type: "topic-changed", Change: Change{Number: 42, Topic: "run-ci"}}
+	if err := HandleTopicChanged(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Error("Expected a closed change not to be built")
+	}
+
+	g.MockQueryChanges = func(query string, options ...string) ([]QueriedChange, error) {
+		return []QueriedChange{{Change: Change{Number: 42}, Open: true, CurrentPatchSet: &PatchSet{Number: 3}}}, nil
+	}
+	withGerrit(t, g)
+	if err := HandleTopicChanged(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	event.OldTopic = "run-ci"
+	if err := HandleTopicChanged(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 1 {
+		t.Errorf("Expected one build, but CreateBuild was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+}
+
+func TestItDoesNotRebuildAPendingTopicBuildWhenAHashtagIsAdded(t *testing.T) {
+	c := defaultConfig()
+	c.Hashtags.Build = []string{"run-ci"}
+	c.TopicBuilds.Enabled = true
+	withConfig(t, c, map[string]BuildPipeline{})
+	withGerrit(t, NewMockGerritChanges(map[string][]QueriedChange{
+		"change:42": {{Change: Change{Number: 42, Topic: "cross"}, Open: true, CurrentPatchSet: &PatchSet{Number: 3}}},
+	}))
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	b.MockGetPatch = func(ctx context.Context, patch *backend.Patch) (*backend.PatchBuild, error) {
+		return &backend.PatchBuild{BuildNumber: 5, State: "running", Trigger: backend.TriggerTopic, Patch: patch}, nil
+	}
+
+	event := Event{Type: "hashtags-changed", Change: Change{Number: 42}, Added: []string{"run-ci"}}
+	if err := HandleHashtagsChanged(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Errorf("Expected the running topic build to be kept, but CreateBuild was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+}
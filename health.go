@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// StreamState tracks the connection state of a Gerrit event stream
+type StreamState struct {
+	mu             sync.RWMutex
+	connected      bool
+	stopped        bool
+	connectedAt    time.Time
+	disconnectedAt time.Time
+	lastEventAt    time.Time
+}
+
+// StreamStatus is a point in time copy of a StreamState
+type StreamStatus struct {
+	Connected      bool      `json:"connected"`
+	Stopped        bool      `json:"stopped"`
+	ConnectedAt    time.Time `json:"connectedAt,omitempty"`
+	DisconnectedAt time.Time `json:"disconnectedAt,omitempty"`
+	LastEventAt    time.Time `json:"lastEventAt,omitempty"`
+}
+
+// NewStreamState creates a disconnected StreamState
+func NewStreamState() *StreamState {
+	return &StreamState{disconnectedAt: time.Now()}
+}
+
+func (s *StreamState) setConnected(connected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+	if connected {
+		s.connectedAt = time.Now()
+		return
+	}
+	s.disconnectedAt = time.Now()
+}
+
+func (s *StreamState) setStopped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = false
+	s.stopped = true
+	s.disconnectedAt = time.Now()
+}
+
+func (s *StreamState) eventReceived() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastEventAt = time.Now()
+}
+
+// Status returns the current state of the stream
+func (s *StreamState) Status() StreamStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return StreamStatus{
+		Connected:      s.connected,
+		Stopped:        s.stopped,
+		ConnectedAt:    s.connectedAt,
+		DisconnectedAt: s.disconnectedAt,
+		LastEventAt:    s.lastEventAt,
+	}
+}
+
+// Pinger checks that a dependency is reachable
+type Pinger interface {
+	Ping(context.Context) error
+}
+
+// HealthChecker serves /healthz and /readyz from the state of the event stream and its dependencies
+type HealthChecker struct {
+	Stream *StreamState
+	// Backend is pinged for readiness when set
+	Backend backend.Backend
+	// Buildkite is pinged for readiness when set
+	Buildkite Pinger
+	// DisconnectedAfter is how long the stream may be disconnected before it is unhealthy
+	DisconnectedAfter time.Duration
+	// StaleAfter is how long without an event before the stream is unhealthy. Zero disables
+	StaleAfter time.Duration
+	// Timeout for each dependency check. Zero checks without a deadline
+	Timeout time.Duration
+}
+
+// HealthCheck is the outcome of a single check
+type HealthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// HealthReport is the response body of /healthz and /readyz
+type HealthReport struct {
+	OK     bool                   `json:"ok"`
+	Stream StreamStatus           `json:"stream"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+func (r *HealthReport) add(name string, err error) {
+	check := HealthCheck{OK: err == nil}
+	if err != nil {
+		check.Error = err.Error()
+		r.OK = false
+	}
+	r.Checks[name] = check
+}
+
+// checkStream reports whether the event stream is running, connected recently and receiving events
+func (h *HealthChecker) checkStream(status StreamStatus, now time.Time) error {
+	if status.Stopped {
+		return fmt.Errorf("event stream listener stopped at %s", status.DisconnectedAt.Format(time.RFC3339))
+	}
+	if !status.Connected && h.DisconnectedAfter > 0 && now.Sub(status.DisconnectedAt) > h.DisconnectedAfter {
+		return fmt.Errorf("event stream disconnected since %s", status.DisconnectedAt.Format(time.RFC3339))
+	}
+	if h.StaleAfter > 0 && status.Connected {
+		lastSeen := status.LastEventAt
+		if lastSeen.Before(status.ConnectedAt) {
+			lastSeen = status.ConnectedAt
+		}
+		if now.Sub(lastSeen) > h.StaleAfter {
+			return fmt.Errorf("no events since %s", lastSeen.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Liveness reports whether the event stream is alive
+func (h *HealthChecker) Liveness(now time.Time) *HealthReport {
+	report := &HealthReport{OK: true, Stream: h.Stream.Status(), Checks: map[string]HealthCheck{}}
+	report.add("stream", h.checkStream(report.Stream, now))
+	return report
+}
+
+// checkContext bounds a dependency check by Timeout
+func (h *HealthChecker) checkContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if h.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, h.Timeout)
+}
+
+// Readiness reports whether the event stream is connected and dependencies answer
+func (h *HealthChecker) Readiness(ctx context.Context, now time.Time) *HealthReport {
+	report := h.Liveness(now)
+	if !report.Stream.Connected {
+		report.add("streamConnected", fmt.Errorf("event stream is not connected"))
+	}
+	if h.Backend != nil {
+		ctx, cancel := h.checkContext(ctx)
+		report.add("backend", h.Backend.Ping(ctx))
+		cancel()
+	}
+	if h.Buildkite != nil {
+		ctx, cancel := h.checkContext(ctx)
+		report.add("buildkite", h.Buildkite.Ping(ctx))
+		cancel()
+	}
+	return report
+}
+
+func writeHealthReport(w http.ResponseWriter, report *HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Error().Err(err).Msg("Failed to write health report")
+	}
+}
+
+// Register adds /healthz and /readyz to mux
+func (h *HealthChecker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, h.Liveness(time.Now()))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := h.Readiness(r.Context(), time.Now())
+		if !report.OK {
+			log.Warn().Any("checks", report.Checks).Msg("Not ready")
+		}
+		writeHealthReport(w, report)
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLivenessFailsWhenTheListenerStops(t *testing.T) {
+	h := &HealthChecker{Stream: NewStreamState(), DisconnectedAfter: time.Minute}
+	h.Stream.setConnected(true)
+	if report := h.Liveness(time.Now()); !report.OK {
+		t.Fatalf("Expected a connected stream to be live, but got %+v", report.Checks)
+	}
+	h.Stream.setStopped()
+	if report := h.Liveness(time.Now()); report.OK {
+		t.Error("Expected a stopped stream not to be live")
+	}
+}
+
+func TestLivenessFailsWhenDisconnectedTooLong(t *testing.T) {
+	h := &HealthChecker{Stream: NewStreamState(), DisconnectedAfter: time.Minute}
+	if report := h.Liveness(time.Now()); !report.OK {
+		t.Errorf("Expected a recently disconnected stream to be live, but got %+v", report.Checks)
+	}
+	if report := h.Liveness(time.Now().Add(2 * time.Minute)); report.OK {
+		t.Error("Expected a stream disconnected for longer than DisconnectedAfter not to be live")
+	}
+}
+
+func TestLivenessFailsWhenEventsAreStale(t *testing.T) {
+	h := &HealthChecker{Stream: NewStreamState(), StaleAfter: time.Hour}
+	h.Stream.setConnected(true)
+	h.Stream.eventReceived()
+	if report := h.Liveness(time.Now().Add(30 * time.Minute)); !report.OK {
+		t.Errorf("Expected a stream with a recent event to be live, but got %+v", report.Checks)
+	}
+	if report := h.Liveness(time.Now().Add(2 * time.Hour)); report.OK {
+		t.Error("Expected a stream without events for longer than StaleAfter not to be live")
+	}
+}
+
+func TestReadinessChecksTheBackend(t *testing.T) {
+	b := NewMockBackend()
+	h := &HealthChecker{Stream: NewStreamState(), Backend: b, Timeout: time.Second}
+	h.Stream.setConnected(true)
+
+	mux := http.NewServeMux()
+	h.Register(mux)
+	res := httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("Expected /readyz to be 200, but got %d: %s", res.Code, res.Body.String())
+	}
+
+	b.MockPing = func(ctx context.Context) error {
+		return fmt.Errorf("connection refused")
+	}
+	h.Backend = b
+	res = httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz to be 503 when the backend is down, but got %d", res.Code)
+	}
+}
+
+func TestReadinessChecksWithoutADeadlineWhenTimeoutIsZero(t *testing.T) {
+	b := NewMockBackend()
+	b.MockPing = func(ctx context.Context) error {
+		return ctx.Err()
+	}
+	h := &HealthChecker{Stream: NewStreamState(), Backend: b}
+	h.Stream.setConnected(true)
+
+	if report := h.Readiness(context.Background(), time.Now()); !report.OK {
+		t.Errorf("Expected a zero Timeout not to expire the checks, but got %+v", report.Checks)
+	}
+}
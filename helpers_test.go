@@ -20,7 +20,9 @@ func (m *MockedInterface) ResetAll() {
 
 type MockPipeline struct {
 	MockCreateBuild func(*buildkite.CreateBuild) (int, error)
-	MockCancelBuild func(int) error
+	MockCancelBuild func(int) (CancelResult, error)
+	MockGetBuild    func(int) (*Build, error)
+	MockSlug        string
 	*MockedInterface
 }
 
@@ -28,15 +30,36 @@ func (m MockPipeline) CreateBuild(build *buildkite.CreateBuild) (int, error) {
 	m.FunctionCallCounter["CreateBuild"]++
 	return m.MockCreateBuild(build)
 }
-func (m MockPipeline) CancelBuild(buildNumber int) error {
+func (m MockPipeline) CancelBuild(buildNumber int) (CancelResult, error) {
 	m.FunctionCallCounter["CancelBuild"]++
 	return m.MockCancelBuild(buildNumber)
 }
+func (m MockPipeline) GetBuild(buildNumber int) (*Build, error) {
+	m.FunctionCallCounter["GetBuild"]++
+	return m.MockGetBuild(buildNumber)
+}
+func (m MockPipeline) Slug() string {
+	return m.MockSlug
+}
 
 type MockBackend struct {
 	MockSaveBuild func(context.Context, *backend.PatchBuild) error
-	MockGetBuild  func(ctx context.Context, buildNumber int) (*backend.PatchBuild, error)
+	MockGetBuild  func(ctx context.Context, pipeline string, buildNumber int) (*backend.PatchBuild, error)
 	MockGetPatch  func(context.Context, *backend.Patch) (*backend.PatchBuild, error)
+	MockPing      func(context.Context) error
+
+	MockSaveCarriedBuild func(ctx context.Context, patch *backend.Patch, pb *backend.PatchBuild) error
+	MockSaveBuildState   func(ctx context.Context, pipeline string, buildNumber int, state string) error
+	MockGetChangeBuilds  func(ctx context.Context, change int) ([]*backend.PatchBuild, error)
+	MockSaveCurrentPatch func(context.Context, *backend.Patch) error
+	MockGetCurrentPatch  func(ctx context.Context, change int) (int, error)
+	MockAddAttention     func(ctx context.Context, change int, accounts ...string) error
+	MockGetAttention     func(ctx context.Context, change int) ([]string, error)
+	MockClearAttention   func(ctx context.Context, change int) error
+	MockAddChildChange   func(ctx context.Context, parent, child int) error
+	MockGetChildChanges  func(ctx context.Context, parent int) ([]int, error)
+	MockMarkPatchWaiting func(context.Context, *backend.Patch) (bool, error)
+	MockClaimRevision    func(ctx context.Context, revision string) (bool, error)
 	*MockedInterface
 }
 
@@ -44,22 +67,78 @@ func (b MockBackend) SaveBuild(ctx context.Context, pb *backend.PatchBuild) erro
 	b.FunctionCallCounter["SaveBuild"]++
 	return b.MockSaveBuild(ctx, pb)
 }
-func (b MockBackend) GetBuild(ctx context.Context, buildNumber int) (*backend.PatchBuild, error) {
+func (b MockBackend) GetBuild(ctx context.Context, pipeline string, buildNumber int) (*backend.PatchBuild, error) {
 	b.FunctionCallCounter["GetBuild"]++
-	return b.MockGetBuild(ctx, buildNumber)
+	return b.MockGetBuild(ctx, pipeline, buildNumber)
 }
 func (b MockBackend) GetPatch(ctx context.Context, p *backend.Patch) (*backend.PatchBuild, error) {
 	b.FunctionCallCounter["GetPatch"]++
 	return b.MockGetPatch(ctx, p)
 }
+func (b MockBackend) SaveCarriedBuild(ctx context.Context, patch *backend.Patch, pb *backend.PatchBuild) error {
+	b.FunctionCallCounter["SaveCarriedBuild"]++
+	return b.MockSaveCarriedBuild(ctx, patch, pb)
+}
+func (b MockBackend) SaveBuildState(ctx context.Context, pipeline string, buildNumber int, state string) error {
+	b.FunctionCallCounter["SaveBuildState"]++
+	return b.MockSaveBuildState(ctx, pipeline, buildNumber, state)
+}
+func (b MockBackend) GetChangeBuilds(ctx context.Context, change int) ([]*backend.PatchBuild, error) {
+	b.FunctionCallCounter["GetChangeBuilds"]++
+	return b.MockGetChangeBuilds(ctx, change)
+}
+func (b MockBackend) SaveCurrentPatch(ctx context.Context, p *backend.Patch) error {
+	b.FunctionCallCounter["SaveCurrentPatch"]++
+	return b.MockSaveCurrentPatch(ctx, p)
+}
+func (b MockBackend) GetCurrentPatch(ctx context.Context, change int) (int, error) {
+	b.FunctionCallCounter["GetCurrentPatch"]++
+	return b.MockGetCurrentPatch(ctx, change)
+}
+func (b MockBackend) AddAttention(ctx context.Context, change int, accounts ...string) error {
+	b.FunctionCallCounter["AddAttention"]++
+	return b.MockAddAttention(ctx, change, accounts...)
+}
+func (b MockBackend) GetAttention(ctx context.Context, change int) ([]string, error) {
+	b.FunctionCallCounter["GetAttention"]++
+	return b.MockGetAttention(ctx, change)
+}
+func (b MockBackend) ClearAttention(ctx context.Context, change int) error {
+	b.FunctionCallCounter["ClearAttention"]++
+	return b.MockClearAttention(ctx, change)
+}
+func (b MockBackend) AddChildChange(ctx context.Context, parent, child int) error {
+	b.FunctionCallCounter["AddChildChange"]++
+	return b.MockAddChildChange(ctx, parent, child)
+}
+func (b MockBackend) GetChildChanges(ctx context.Context, parent int) ([]int, error) {
+	b.FunctionCallCounter["GetChildChanges"]++
+	return b.MockGetChildChanges(ctx, parent)
+}
+func (b MockBackend) MarkPatchWaiting(ctx context.Context, patch *backend.Patch) (bool, error) {
+	b.FunctionCallCounter["MarkPatchWaiting"]++
+	return b.MockMarkPatchWaiting(ctx, patch)
+}
+func (b MockBackend) ClaimRevision(ctx context.Context, revision string) (bool, error) {
+	b.FunctionCallCounter["ClaimRevision"]++
+	return b.MockClaimRevision(ctx, revision)
+}
+func (b MockBackend) Ping(ctx context.Context) error {
+	b.FunctionCallCounter["Ping"]++
+	return b.MockPing(ctx)
+}
 func NewMockPipeline() MockPipeline {
 	return MockPipeline{
 		MockedInterface: &MockedInterface{map[string]int{}},
+		MockSlug:        "mock-pipeline",
 		MockCreateBuild: func(build *buildkite.CreateBuild) (int, error) {
 			return 1, nil
 		},
-		MockCancelBuild: func(buildNumber int) error {
-			return nil
+		MockCancelBuild: func(buildNumber int) (CancelResult, error) {
+			return CancelResultCancelled, nil
+		},
+		MockGetBuild: func(buildNumber int) (*Build, error) {
+			return &Build{Number: buildNumber, State: "running"}, nil
 		},
 	}
 }
@@ -69,11 +148,108 @@ func NewMockBackend() MockBackend {
 		MockSaveBuild: func(ctx context.Context, pb *backend.PatchBuild) error {
 			return nil
 		},
-		MockGetBuild: func(ctx context.Context, buildNumber int) (*backend.PatchBuild, error) {
+		MockGetBuild: func(ctx context.Context, pipeline string, buildNumber int) (*backend.PatchBuild, error) {
 			return nil, nil
 		},
 		MockGetPatch: func(ctx context.Context, p *backend.Patch) (*backend.PatchBuild, error) {
 			return nil, nil
 		},
+		MockPing: func(ctx context.Context) error {
+			return nil
+		},
+		MockSaveCarriedBuild: func(ctx context.Context, patch *backend.Patch, pb *backend.PatchBuild) error {
+			return nil
+		},
+		MockSaveBuildState: func(ctx context.Context, pipeline string, buildNumber int, state string) error {
+			return nil
+		},
+		MockGetChangeBuilds: func(ctx context.Context, change int) ([]*backend.PatchBuild, error) {
+			return []*backend.PatchBuild{}, nil
+		},
+		MockSaveCurrentPatch: func(ctx context.Context, p *backend.Patch) error {
+			return nil
+		},
+		MockGetCurrentPatch: func(ctx context.Context, change int) (int, error) {
+			return 0, backend.ErrPatchNotFound
+		},
+		MockAddAttention: func(ctx context.Context, change int, accounts ...string) error {
+			return nil
+		},
+		MockGetAttention: func(ctx context.Context, change int) ([]string, error) {
+			return []string{}, nil
+		},
+		MockClearAttention: func(ctx context.Context, change int) error {
+			return nil
+		},
+		MockAddChildChange: func(ctx context.Context, parent, child int) error {
+			return nil
+		},
+		MockGetChildChanges: func(ctx context.Context, parent int) ([]int, error) {
+			return []int{}, nil
+		},
+		MockMarkPatchWaiting: func(ctx context.Context, patch *backend.Patch) (bool, error) {
+			return true, nil
+		},
+		MockClaimRevision: func(ctx context.Context, revision string) (bool, error) {
+			return true, nil
+		},
+	}
+}
+
+type MockGerrit struct {
+	MockQueryChanges     func(query string, options ...string) ([]QueriedChange, error)
+	MockSetReviewState   func(*Review) error
+	MockListGroupMembers func(group string) ([]User, error)
+	*MockedInterface
+}
+
+func (g MockGerrit) QueryChanges(query string, options ...string) ([]QueriedChange, error) {
+	g.FunctionCallCounter["QueryChanges"]++
+	return g.MockQueryChanges(query, options...)
+}
+func (g MockGerrit) SetReviewState(r *Review) error {
+	g.FunctionCallCounter["SetReviewState"]++
+	return g.MockSetReviewState(r)
+}
+func (g MockGerrit) ListGroupMembers(group string) ([]User, error) {
+	g.FunctionCallCounter["ListGroupMembers"]++
+	return g.MockListGroupMembers(group)
+}
+func NewMockGerrit() MockGerrit {
+	return MockGerrit{
+		MockedInterface: &MockedInterface{map[string]int{}},
+		MockQueryChanges: func(query string, options ...string) ([]QueriedChange, error) {
+			return []QueriedChange{}, nil
+		},
+		MockSetReviewState: func(r *Review) error {
+			return nil
+		},
+		MockListGroupMembers: func(group string) ([]User, error) {
+			return []User{}, nil
+		},
+	}
+}
+
+// NewMockGerritChanges returns a MockGerrit which answers each query with its changes and other queries with none
+func NewMockGerritChanges(changes map[string][]QueriedChange) MockGerrit {
+	g := NewMockGerrit()
+	g.MockQueryChanges = func(query string, options ...string) ([]QueriedChange, error) {
+		if queried, ok := changes[query]; ok {
+			return queried, nil
+		}
+		return []QueriedChange{}, nil
+	}
+	return g
+}
+
+// NewMockWebhook returns a webhook of build 7 in a state and makes the backend find the build for a patch set
+func NewMockWebhook(b *MockBackend, event, state string, patch *backend.Patch) BuildkiteWebhook {
+	b.MockGetBuild = func(ctx context.Context, pipeline string, buildNumber int) (*backend.PatchBuild, error) {
+		return &backend.PatchBuild{Patch: patch, BuildNumber: buildNumber, Pipeline: pipeline}, nil
+	}
+	return BuildkiteWebhook{
+		Event:    event,
+		Pipeline: BuildkitePipeline{Slug: "mock-pipeline"},
+		Build:    Build{Number: 7, State: state},
 	}
 }
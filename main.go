@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"time"
 
 	"github.com/buildkite/go-buildkite/buildkite"
 	"github.com/mrmod/gerrit-buildkite/backend"
@@ -32,71 +35,82 @@ var (
 	flagBuildkiteWebhookHandlerDisabled = flag.Bool("disable-buildkite-webhook-handler", true, "Disable Buildkite webhook handler when passed")
 	flagWebhookHandlerPort              = flag.String("webhook-handler-port", "10005", "Port to listen for Buildkite webhook events. Ex: 8080")
 
-	flagLoggingTraceEnabled = flag.Bool("enable-trace-logging", false, "Enable trace logging")
-	flagLoggingDebugEnabled = flag.Bool("enable-debug-logging", false, "Enable debug logging")
-)
+	flagMetricsPort = flag.String("metrics-port", "10006", "Port to serve /metrics, /healthz and /readyz on. Empty disables. Ex: 9090")
 
-func handleSSHEventStream() {
-	// Buffer up to 16 events in the stream
-	eventStream := make(chan Event, 16)
+	flagHealthDisconnectedAfter = flag.Duration("health-disconnected-after", 2*time.Minute, "How long the Gerrit event stream may be disconnected before /healthz fails")
+	flagHealthStaleAfter        = flag.Duration("health-stale-after", 0, "How long without a Gerrit event before /healthz fails. 0 disables. Ex: 1h")
+	flagHealthCheckTimeout      = flag.Duration("health-check-timeout", 5*time.Second, "Timeout for each /readyz dependency check")
 
-	_backend := backend.NewRedisBackend()
-	client, err := NewGerritSSHClient(*flagGerritSshUrl, *flagGerritSshKeyPath)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to create Gerrit SSH client")
-	}
+	flagAdminApiPort      = flag.String("admin-api-port", "", "Port to serve the admin API on. Empty disables. Ex: 10007")
+	flagAdminApiTokenPath = flag.String("admin-api-token-path", "/path/to/credentials", "File with the bearer token required by the admin API")
 
-	if !*flagBuildkiteWebhookHandlerDisabled {
-		log.Debug().
-			Str("webhookHandlerPort", *flagWebhookHandlerPort).
-			Msg("Starting Buildkite webhook handler")
-		webhookStream := make(chan BuildkiteWebhook, 16)
-		webhookHandler, err := NewBuildkiteWebhookHandler(*flagBuildkiteOrgSlug, *flagBuildkitePipelineSlug, *flagBuildkiteApiUrl, *flagBuildkiteApiTokenPath)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Failed to create Buildkite webhook handler")
-		}
-		webhookHandler.HookEvents = webhookStream
+	flagConfigPath = flag.String("config-path", "", "YAML file configuring named pipelines and comment commands. Empty uses the defaults")
 
-		go func() {
-			log.Debug().Str("port", *flagWebhookHandlerPort).Msg("Listening for Buildkite webhook events")
-			http.ListenAndServe(":"+*flagWebhookHandlerPort, webhookHandler)
-		}()
+	flagOtlpTracesEndpoint = flag.String("otlp-traces-endpoint", "", "OTLP/HTTP endpoint to export traces to. Empty disables tracing. Ex: http://otel-collector:4318/v1/traces")
 
-		webhookHandler.Backend = _backend
-		log.Info().Msg("Started Webhook event handler")
-		go HandleWebhookEvents(webhookStream, client, _backend)
-	}
+	flagLoggingTraceEnabled = flag.Bool("enable-trace-logging", false, "Enable trace logging")
+	flagLoggingDebugEnabled = flag.Bool("enable-debug-logging", false, "Enable debug logging")
+)
 
+// newPipeline creates the Buildkite pipeline configured by flags
+func newPipeline() (*Pipeline, error) {
 	apiUrl, err := url.Parse(*flagBuildkiteApiUrl)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to parse Buildkite Api Url")
+		return nil, fmt.Errorf("failed to parse Buildkite Api Url: %w", err)
 	}
 	apiToken, err := readToken(*flagBuildkiteApiTokenPath)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Failed to read api token: %s", *flagBuildkiteApiTokenPath)
+		return nil, fmt.Errorf("failed to read api token %s: %w", *flagBuildkiteApiTokenPath, err)
 	}
 
 	apiTransport, err := buildkite.NewTokenConfig(apiToken, *flagLoggingTraceEnabled)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to create Buildkite Api client")
+		return nil, fmt.Errorf("failed to create Buildkite Api client: %w", err)
 	}
 
 	log.Debug().Str("host", apiUrl.Host).Msgf("Setting API host")
 
-	pipeline := &Pipeline{
+	return &Pipeline{
 		OrgSlug:      *flagBuildkiteOrgSlug,
 		PipelineSlug: *flagBuildkitePipelineSlug,
 		ApiUrl:       apiUrl,
 		ApiClient:    apiTransport.Client(),
+	}, nil
+}
+
+// setupConfig loads --config-path and registers its named pipelines alongside the default pipeline.
+// Comments by the Gerrit user of client are ignored so the bridge never reacts to its own reviews.
+func setupConfig(p *Pipeline, client *GerritSSHClient) error {
+	c, err := loadConfig(*flagConfigPath)
+	if err != nil {
+		return err
+	}
+	config = c
+	config.Commands.IgnoreAuthors = append(config.Commands.IgnoreAuthors, client.User.Username())
+	for name, slug := range config.Pipelines {
+		pipelines[name] = p.WithSlug(slug)
 	}
+	return nil
+}
+
+// registerEventHandlers adds the handlers of enabled features to the eventRouter
+func registerEventHandlers(client *GerritSSHClient) {
 	// TODO: An EventHandler should have an Setup(EventRouter{}) sync Function
 	// TODO: An EventHandler should have a Handle(InstrumentedEvent{Event{}, :TraceId}, ResultChan{:*Error, :TraceId}) async Function
 	// TODO: An IntrumentedIntegration should have GetResult(:TraceId) {Done, Error, Running, Pending} sync Function. The order allows `> Done` guard.
 	if *flagEnableBuildkiteIntegration {
 		log.Debug().Msg("Buildkite integration enabled")
-		eventRouter["patchset-created"] = append(eventRouter["patchset-created"], HandlePatchsetCreated)
-		eventRouter["comment-added"] = append(eventRouter["comment-added"], HandleCommentAdded)
-		eventRouter["ref-updated"] = append(eventRouter["ref-updated"], HandleRefUpdated)
+		eventRouter["patchset-created"] = append(eventRouter["patchset-created"], instrumentHandler("HandlePatchsetCreated", HandlePatchsetCreated))
+		eventRouter["comment-added"] = append(eventRouter["comment-added"], instrumentHandler("HandleCommentAdded", HandleCommentAdded))
+		eventRouter["comment-added"] = append(eventRouter["comment-added"], instrumentHandler("HandleVoteTriggers", HandleVoteTriggers))
+		eventRouter["ref-updated"] = append(eventRouter["ref-updated"], instrumentHandler("HandleRefUpdated", HandleRefUpdated))
+		eventRouter["change-merged"] = append(eventRouter["change-merged"], instrumentHandler("HandleChangeMerged", HandleChangeMerged))
+		eventRouter["change-abandoned"] = append(eventRouter["change-abandoned"], instrumentHandler("HandleChangeClosed", HandleChangeClosed))
+		eventRouter["change-deleted"] = append(eventRouter["change-deleted"], instrumentHandler("HandleChangeClosed", HandleChangeClosed))
+		eventRouter["change-restored"] = append(eventRouter["change-restored"], instrumentHandler("HandleChangeRestored", HandleChangeRestored))
+		eventRouter["wip-state-changed"] = append(eventRouter["wip-state-changed"], instrumentHandler("HandleWipStateChanged", HandleWipStateChanged))
+		eventRouter["hashtags-changed"] = append(eventRouter["hashtags-changed"], instrumentHandler("HandleHashtagsChanged", HandleHashtagsChanged))
+		eventRouter["topic-changed"] = append(eventRouter["topic-changed"], instrumentHandler("HandleTopicChanged", HandleTopicChanged))
 	}
 
 	if *flagEnableChangeReplication {
@@ -116,11 +130,99 @@ func handleSSHEventStream() {
 		}
 		replicator := NewSSHReplicator(&client.GitSSHRemote, destinationRepository, *flagReplicationClonePath)
 		handleReplication := func(event Event, p BuildPipeline, b backend.Backend) error {
+			start := time.Now()
 			// Replicate from refs/changes/01/2/1 to change-3
-			return replicator.Replicate(event.PatchSet.Ref, fmt.Sprintf("change-%d", event.Change.Number))
+			err := replicator.Replicate(event.PatchSet.Ref, fmt.Sprintf("change-%d", event.Change.Number))
+			metricReplicationDuration.WithLabelValues(resultLabel(err)).Observe(time.Since(start).Seconds())
+			return err
 		}
 
-		eventRouter["patchset-created"] = append(eventRouter["patchset-created"], handleReplication)
+		eventRouter["patchset-created"] = append(eventRouter["patchset-created"], instrumentHandler("handleReplication", handleReplication))
+	}
+}
+
+func handleSSHEventStream() {
+	shutdownTracing, err := setupTracing(context.Background(), *flagOtlpTracesEndpoint)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to setup tracing")
+	}
+	defer shutdownTracing(context.Background())
+
+	// Buffer up to 16 events in the stream
+	eventStream := make(chan Event, 16)
+	registerChannelDepth("gerrit_events", eventStream)
+
+	_backend := backend.NewRedisBackend(*flagBuildkitePipelineSlug)
+	client, err := NewGerritSSHClient(*flagGerritSshUrl, *flagGerritSshKeyPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create Gerrit SSH client")
+	}
+	gerritClient = client
+
+	pipeline, err := newPipeline()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create Buildkite pipeline")
+	}
+	if err := setupConfig(pipeline, client); err != nil {
+		log.Fatal().Err(err).Str("configPath", *flagConfigPath).Msg("Failed to load config")
+	}
+
+	if !*flagBuildkiteWebhookHandlerDisabled {
+		log.Debug().
+			Str("webhookHandlerPort", *flagWebhookHandlerPort).
+			Msg("Starting Buildkite webhook handler")
+		webhookStream := make(chan BuildkiteWebhook, 16)
+		registerChannelDepth("buildkite_webhooks", webhookStream)
+		webhookHandler, err := NewBuildkiteWebhookHandler(*flagBuildkiteOrgSlug, *flagBuildkitePipelineSlug, *flagBuildkiteApiUrl, *flagBuildkiteApiTokenPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create Buildkite webhook handler")
+		}
+		webhookHandler.HookEvents = webhookStream
+
+		go func() {
+			log.Debug().Str("port", *flagWebhookHandlerPort).Msg("Listening for Buildkite webhook events")
+			http.ListenAndServe(":"+*flagWebhookHandlerPort, webhookHandler)
+		}()
+
+		webhookHandler.Backend = _backend
+		log.Info().Msg("Started Webhook event handler")
+		go HandleWebhookEvents(webhookStream, client, pipeline, _backend)
+	}
+
+	registerEventHandlers(client)
+	if *flagAdminApiPort != "" {
+		adminApi, err := NewAdminAPI(*flagAdminApiTokenPath, pipeline, _backend, client, recentEvents)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create admin API")
+		}
+		go func() {
+			log.Debug().Str("port", *flagAdminApiPort).Msg("Serving admin API")
+			if err := http.ListenAndServe(":"+*flagAdminApiPort, adminApi); err != nil {
+				log.Error().Err(err).Msg("Admin API server stopped")
+			}
+		}()
+	}
+
+	if *flagMetricsPort != "" {
+		healthChecker := &HealthChecker{
+			Stream:            client.Stream,
+			Backend:           _backend,
+			DisconnectedAfter: *flagHealthDisconnectedAfter,
+			StaleAfter:        *flagHealthStaleAfter,
+			Timeout:           *flagHealthCheckTimeout,
+		}
+		if *flagEnableBuildkiteIntegration {
+			healthChecker.Buildkite = pipeline
+		}
+		mux := http.NewServeMux()
+		registerMetrics(mux)
+		healthChecker.Register(mux)
+		go func() {
+			log.Debug().Str("port", *flagMetricsPort).Msg("Serving metrics and health checks")
+			if err := http.ListenAndServe(":"+*flagMetricsPort, mux); err != nil {
+				log.Error().Err(err).Msg("Metrics and health check server stopped")
+			}
+		}()
 	}
 	go client.Handle(eventStream, pipeline, _backend)
 	log.Info().Msg("Listening for Gerrit events")
@@ -128,6 +230,12 @@ func handleSSHEventStream() {
 }
 
 func initFlags() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nRuns the event handler when no command is given.\n\n", os.Args[0])
+		printCommandUsage()
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 }
 func main() {
@@ -140,6 +248,13 @@ func main() {
 		zerolog.SetGlobalLevel(zerolog.TraceLevel)
 	}
 
+	if args := flag.Args(); len(args) > 0 {
+		if err := runCommand(args); err != nil {
+			log.Fatal().Err(err).Str("command", args[0]).Msg("Command failed")
+		}
+		return
+	}
+
 	switch *flagStreamType {
 	case "ssh":
 		handleSSHEventStream()
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// Prometheus metrics for the bridge. Exposed on /metrics by registerMetrics.
+
+const metricsNamespace = "gerrit_buildkite"
+
+var (
+	metricEventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gerrit_events_received_total",
+		Help:      "Gerrit events received from the event stream by event type",
+	}, []string{"event_type"})
+
+	metricHandlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "event_handler_duration_seconds",
+		Help:      "Time spent in a Gerrit event handler",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler", "event_type"})
+
+	metricHandlerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "event_handler_errors_total",
+		Help:      "Gerrit event handler errors and recovered panics",
+	}, []string{"handler", "event_type"})
+
+	metricWebhooksHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "buildkite_webhooks_total",
+		Help:      "Buildkite webhooks by event and result. Ex: success, error, unknown_build or rejected when the queue is full",
+	}, []string{"event", "result"})
+
+	metricBuildkiteApiRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "buildkite_api_requests_total",
+		Help:      "Buildkite API requests by operation and HTTP status code",
+	}, []string{"operation", "code"})
+
+	metricBuildsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "builds_created_total",
+		Help:      "Buildkite builds created",
+	})
+
+	metricLastBuildCreated = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_build_created_timestamp_seconds",
+		Help:      "Unix time the last Buildkite build was created",
+	})
+
+	metricBuildsCancelled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "builds_cancelled_total",
+		Help:      "Buildkite builds cancelled",
+	})
+
+	metricReviewPosts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gerrit_review_posts_total",
+		Help:      "Reviews posted to Gerrit by result",
+	}, []string{"result"})
+
+	metricSSHReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "gerrit_ssh_reconnects_total",
+		Help:      "Reconnections to the Gerrit SSH event stream",
+	})
+
+	metricReplicationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "replication_duration_seconds",
+		Help:      "Time spent replicating a change to the destination repository",
+		Buckets:   []float64{1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"result"})
+)
+
+// registerChannelDepth exposes the number of items waiting in a channel
+func registerChannelDepth[T any](name string, c chan T) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   metricsNamespace,
+		Name:        "channel_depth",
+		Help:        "Items buffered in an internal channel",
+		ConstLabels: prometheus.Labels{"channel": name},
+	}, func() float64 {
+		return float64(len(c))
+	})
+}
+
+// resultLabel is "success" when err is nil, otherwise "error"
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// statusCodeLabel returns the status code of a response or "error" when there was none
+func statusCodeLabel(res *http.Response) string {
+	if res == nil {
+		return "error"
+	}
+	return fmt.Sprint(res.StatusCode)
+}
+
+// instrumentHandler traces and records the duration and errors of an EventHandlerFunc under name
+// and adds its outcome to the event in recentEvents
+func instrumentHandler(name string, handler EventHandlerFunc) EventHandlerFunc {
+	return func(event Event, p BuildPipeline, b backend.Backend) (err error) {
+		start := time.Now()
+		ctx, span := tracer.Start(event.Context(), name)
+		event = event.WithContext(ctx)
+		defer func() {
+			duration := time.Since(start)
+			metricHandlerDuration.WithLabelValues(name, event.Type).Observe(duration.Seconds())
+			if r := recover(); r != nil {
+				log.Error().
+					Any("panic", r).
+					Str("handler", name).
+					Msg("Panic recovered")
+				err = fmt.Errorf("handler %s panicked: %v", name, r)
+			}
+			if err != nil {
+				metricHandlerErrors.WithLabelValues(name, event.Type).Inc()
+			}
+			recentEvents.AddOutcome(event, name, duration, err)
+			endSpan(span, err)
+		}()
+		return handler(event, p, b)
+	}
+}
+
+// registerMetrics adds the Prometheus /metrics handler to mux
+func registerMetrics(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.Handler())
+}
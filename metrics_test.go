@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentedHandlerCountsErrors(t *testing.T) {
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	event := Event{Type: "patchset-created"}
+
+	failing := instrumentHandler("testFailingHandler", func(Event, BuildPipeline, backend.Backend) error {
+		return fmt.Errorf("failed")
+	})
+	if err := failing(event, p, b); err == nil {
+		t.Fatal("Expected the handler error to be returned")
+	}
+	if c := testutil.ToFloat64(metricHandlerErrors.WithLabelValues("testFailingHandler", event.Type)); c != 1 {
+		t.Errorf("Expected one handler error to be counted, but counted %v", c)
+	}
+
+	passing := instrumentHandler("testPassingHandler", func(Event, BuildPipeline, backend.Backend) error {
+		return nil
+	})
+	if err := passing(event, p, b); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if c := testutil.ToFloat64(metricHandlerErrors.WithLabelValues("testPassingHandler", event.Type)); c != 0 {
+		t.Errorf("Expected no handler errors to be counted, but counted %v", c)
+	}
+}
+
+func TestInstrumentedHandlerRecoversPanics(t *testing.T) {
+	panicking := instrumentHandler("testPanickingHandler", func(Event, BuildPipeline, backend.Backend) error {
+		panic("boom")
+	})
+	if err := panicking(Event{Type: "comment-added"}, NewMockPipeline(), NewMockBackend()); err == nil {
+		t.Fatal("Expected a recovered panic to be returned as an error")
+	}
+	if c := testutil.ToFloat64(metricHandlerErrors.WithLabelValues("testPanickingHandler", "comment-added")); c != 1 {
+		t.Errorf("Expected one handler error to be counted, but counted %v", c)
+	}
+}
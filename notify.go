@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// Notify levels of Gerrit reviews
+const (
+	NotifyNone           = "NONE"
+	NotifyOwner          = "OWNER"
+	NotifyOwnerReviewers = "OWNER_REVIEWERS"
+	NotifyAll            = "ALL"
+)
+
+var (
+	notifyLevels     = []string{NotifyNone, NotifyOwner, NotifyOwnerReviewers, NotifyAll}
+	notifyRecipients = []string{"TO", "CC", "BCC"}
+	// notifyStates are the message states and fixed, a pass after a failed build of the change
+	notifyStates = append(slices.Clone(messageStates), "fixed")
+)
+
+// NotifyConfig configures who is emailed about build results, by state.
+// States without a level of their own use finished, fixed uses passed.
+//
+//	notify:
+//	  levels:
+//	    failed: OWNER
+//	    fixed: OWNER_REVIEWERS
+//	  details:
+//	    failed:
+//	      CC: [ci-watchers@example.com]
+type NotifyConfig struct {
+	// Levels are NONE, OWNER, OWNER_REVIEWERS or ALL by state
+	Levels map[string]string `yaml:"levels"`
+	// Details are accounts or emails by state and recipient type: TO, CC or BCC
+	Details map[string]map[string][]string `yaml:"details"`
+}
+
+func defaultNotifyConfig() NotifyConfig {
+	return NotifyConfig{
+		Levels: map[string]string{
+			"running":  NotifyNone,
+			"finished": NotifyNone,
+		},
+		Details: map[string]map[string][]string{},
+	}
+}
+
+// Validate checks the states, levels and recipient types
+func (c NotifyConfig) Validate() error {
+	for state, level := range c.Levels {
+		if !slices.Contains(notifyStates, state) {
+			return fmt.Errorf("notify.levels.%s is not one of %s", state, strings.Join(notifyStates, ", "))
+		}
+		if !slices.Contains(notifyLevels, level) {
+			return fmt.Errorf("notify.levels.%s must be one of %s but got %q", state, strings.Join(notifyLevels, ", "), level)
+		}
+	}
+	for state, details := range c.Details {
+		if !slices.Contains(notifyStates, state) {
+			return fmt.Errorf("notify.details.%s is not one of %s", state, strings.Join(notifyStates, ", "))
+		}
+		for recipient := range details {
+			if !slices.Contains(notifyRecipients, recipient) {
+				return fmt.Errorf("notify.details.%s.%s must be one of %s", state, recipient, strings.Join(notifyRecipients, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// fallbackStates are the states whose settings apply to a state without its own
+func fallbackStates(state string) []string {
+	switch state {
+	case "running", "finished":
+		return []string{state}
+	case "fixed":
+		return []string{state, "passed", "finished"}
+	}
+	return []string{state, "finished"}
+}
+
+// notifyLevel is the notify level of a state
+func (c NotifyConfig) notifyLevel(state string) string {
+	for _, s := range fallbackStates(state) {
+		if level, ok := c.Levels[s]; ok {
+			return level
+		}
+	}
+	return NotifyNone
+}
+
+// notifyDetails are the recipients of a state
+func (c NotifyConfig) notifyDetails(state string) map[string][]string {
+	for _, s := range fallbackStates(state) {
+		if details, ok := c.Details[s]; ok {
+			return details
+		}
+	}
+	return nil
+}
+
+// buildFixed checks the build of the same pipeline before a passed build of a change failed
+func buildFixed(ctx context.Context, b backend.Backend, pb *backend.PatchBuild) bool {
+	builds, err := b.GetChangeBuilds(ctx, pb.Change)
+	if err != nil {
+		log.Err(err).
+			Int("change", pb.Change).
+			Msg("Failed to find previous builds of change")
+		return false
+	}
+	var previous *backend.PatchBuild
+	for _, build := range builds {
+		if build.Pipeline != pb.Pipeline || build.BuildNumber >= pb.BuildNumber {
+			continue
+		}
+		if previous == nil || build.BuildNumber > previous.BuildNumber {
+			previous = build
+		}
+	}
+	return previous != nil && previous.State == "failed"
+}
+
+// notifyState is the NotifyConfig state of a webhook build
+func notifyState(ctx context.Context, b backend.Backend, webhook BuildkiteWebhook, pb *backend.PatchBuild) string {
+	if webhook.Event == "build.running" {
+		return "running"
+	}
+	state := messageState(webhook.Build)
+	if state == "passed" && buildFixed(ctx, b, pb) {
+		return "fixed"
+	}
+	return state
+}
+
+// setNotify sets who is emailed about the review of a webhook build
+func setNotify(ctx context.Context, b backend.Backend, webhook BuildkiteWebhook, pb *backend.PatchBuild, review *Review) {
+	state := notifyState(ctx, b, webhook, pb)
+	review.Notify = config.Notify.notifyLevel(state)
+	review.NotifyDetails = config.Notify.notifyDetails(state)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func TestReviewInput(t *testing.T) {
+	input := reviewInput(&Review{
+		Patch:              &backend.Patch{Change: 42, Number: 3},
+		Message:            "Build 7 failed",
+		State:              ReviewStateRejected,
+		NotifyDetails:      map[string][]string{"CC": {"ci-watchers@example.com"}},
+		NotifyEmailAddress: "owner@example.com",
+	})
+	if input.Notify != NotifyNone || input.Tag != reviewTag || input.Labels["Code-Review"] != ReviewStateRejected {
+		t.Errorf("Unexpected review input %+v", input)
+	}
+	expected := map[string]NotifyInfo{
+		"CC": {Accounts: []string{"ci-watchers@example.com"}},
+		"TO": {Accounts: []string{"owner@example.com"}},
+	}
+	if !reflect.DeepEqual(input.NotifyDetails, expected) {
+		t.Errorf("Expected notify details %v, but got %v", expected, input.NotifyDetails)
+	}
+
+	input = reviewInput(&Review{Patch: &backend.Patch{}, OmitVote: true, Notify: NotifyOwner})
+	if input.Labels != nil || input.NotifyDetails != nil || input.Notify != NotifyOwner {
+		t.Errorf("Expected no vote and no details, but got %+v", input)
+	}
+}
+
+func TestNotifyLevels(t *testing.T) {
+	c := defaultNotifyConfig()
+	c.Levels["failed"] = NotifyOwner
+	c.Levels["passed"] = NotifyOwnerReviewers
+	c.Details["failed"] = map[string][]string{"TO": {"oncall"}}
+
+	for state, level := range map[string]string{
+		"running":  NotifyNone,
+		"failed":   NotifyOwner,
+		"fixed":    NotifyOwnerReviewers,
+		"canceled": NotifyNone,
+	} {
+		if got := c.notifyLevel(state); got != level {
+			t.Errorf("Expected %s builds to notify %s, but got %s", state, level, got)
+		}
+	}
+	if c.notifyDetails("failed")["TO"][0] != "oncall" || c.notifyDetails("passed") != nil {
+		t.Error("Expected only failed builds to notify oncall")
+	}
+
+	c.Levels["failed"] = "EVERYONE"
+	if err := c.Validate(); err == nil {
+		t.Error("Expected an unknown notify level to be invalid")
+	}
+}
+
+func TestItNotifiesWhenABuildIsFixed(t *testing.T) {
+	c := defaultConfig()
+	c.Notify.Levels["fixed"] = NotifyOwnerReviewers
+	withConfig(t, c, map[string]BuildPipeline{})
+	b := NewMockBackend()
+	patch := &backend.Patch{Change: 42, Number: 3}
+	b.MockGetBuild = func(ctx context.Context, pipeline string, buildNumber int) (*backend.PatchBuild, error) {
+		return &backend.PatchBuild{Patch: patch, BuildNumber: buildNumber, Pipeline: pipeline}, nil
+	}
+	b.MockGetChangeBuilds = func(ctx context.Context, change int) ([]*backend.PatchBuild, error) {
+		return []*backend.PatchBuild{
+			{Patch: patch, BuildNumber: 5, Pipeline: "mock-pipeline", State: "passed"},
+			{Patch: patch, BuildNumber: 6, Pipeline: "mock-pipeline", State: "failed"},
+			{Patch: patch, BuildNumber: 6, Pipeline: "other-pipeline", State: "passed"},
+			{Patch: patch, BuildNumber: 7, Pipeline: "mock-pipeline", State: "passed"},
+		}, nil
+	}
+	g := NewMockGerrit()
+	var review *Review
+	g.MockSetReviewState = func(r *Review) error {
+		review = r
+		return nil
+	}
+	webhook := BuildkiteWebhook{
+		Event:    "build.finished",
+		Pipeline: BuildkitePipeline{Slug: "mock-pipeline"},
+		Build:    Build{Number: 7, State: "passed"},
+	}
+
+	if err := handleWebhookEvent(context.Background(), webhook, g, NewMockPipeline(), b); err != nil {
+		t.Fatal(err)
+	}
+	if review == nil || review.Notify != NotifyOwnerReviewers {
+		t.Errorf("Expected the fixed build to notify the owner and reviewers, but got %+v", review)
+	}
+
+	webhook.Build.Number = 6
+	webhook.Build.State = "passed"
+	b.MockGetChangeBuilds = func(ctx context.Context, change int) ([]*backend.PatchBuild, error) {
+		return []*backend.PatchBuild{{Patch: patch, BuildNumber: 5, Pipeline: "mock-pipeline", State: "passed"}}, nil
+	}
+	if err := handleWebhookEvent(context.Background(), webhook, g, NewMockPipeline(), b); err != nil {
+		t.Fatal(err)
+	}
+	if review.Notify != NotifyNone {
+		t.Errorf("Expected a pass after a pass not to notify, but got %s", review.Notify)
+	}
+}
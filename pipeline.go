@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -13,7 +14,49 @@ import (
 
 type BuildPipeline interface {
 	CreateBuild(*buildkite.CreateBuild) (buildNumber int, err error)
-	CancelBuild(buildNumber int) error
+	CancelBuild(buildNumber int) (CancelResult, error)
+	// GetBuild fetches a build of the pipeline from Buildkite
+	GetBuild(buildNumber int) (*Build, error)
+	// Slug is the Buildkite slug of the pipeline
+	Slug() string
+}
+
+// pipelines are the Buildkite pipelines builds can be created on by name
+// in addition to the default pipeline. Ex: retest full-ci
+var pipelines = map[string]BuildPipeline{}
+
+// pipelineByName returns the pipeline registered as name or p when name is empty
+func pipelineByName(name string, p BuildPipeline) (BuildPipeline, error) {
+	if name == "" {
+		return p, nil
+	}
+	if named, ok := pipelines[name]; ok {
+		return named, nil
+	}
+	return nil, fmt.Errorf("unknown pipeline %q", name)
+}
+
+// pipelineBySlug returns the pipeline with a Buildkite slug, p when no registered pipeline has it
+func pipelineBySlug(slug string, p BuildPipeline) BuildPipeline {
+	for _, named := range pipelines {
+		if named.Slug() == slug {
+			return named
+		}
+	}
+	return p
+}
+
+// registeredPipeline returns p or the registered pipeline with a Buildkite slug, false for pipelines of other projects
+func registeredPipeline(slug string, p BuildPipeline) (BuildPipeline, bool) {
+	if p.Slug() == slug {
+		return p, true
+	}
+	for _, named := range pipelines {
+		if named.Slug() == slug {
+			return named, true
+		}
+	}
+	return nil, false
 }
 
 // Pipeline represents a Buildkite pipeline
@@ -23,9 +66,26 @@ type Pipeline struct {
 	ApiClient             *http.Client
 }
 
+// Slug is the Buildkite slug of the pipeline
+func (p *Pipeline) Slug() string {
+	return p.PipelineSlug
+}
+
+// WithSlug returns a copy of the pipeline for another pipeline slug in the same organization
+func (p *Pipeline) WithSlug(slug string) *Pipeline {
+	named := *p
+	named.PipelineSlug = slug
+	return &named
+}
+
 // CreateBuild creates a build on a pipeline for a Review
 func (p *Pipeline) CreateBuild(data *buildkite.CreateBuild) (int, error) {
 	build, response, err := p.createBuild(p.ApiClient, data)
+	var res *http.Response
+	if response != nil {
+		res = response.Response
+	}
+	metricBuildkiteApiRequests.WithLabelValues("create_build", statusCodeLabel(res)).Inc()
 	if err != nil {
 		return 0, err
 	}
@@ -37,6 +97,8 @@ func (p *Pipeline) CreateBuild(data *buildkite.CreateBuild) (int, error) {
 		return 0, fmt.Errorf("failed to create build: %d", response.StatusCode)
 	}
 	log.Trace().Any("build", build).Msg("Build created")
+	metricBuildsCreated.Inc()
+	metricLastBuildCreated.SetToCurrentTime()
 	return *build.Number, nil
 }
 
@@ -46,18 +108,53 @@ func (p *Pipeline) createBuild(c *http.Client, request *buildkite.CreateBuild) (
 	return bk.Builds.Create(p.OrgSlug, p.PipelineSlug, request)
 }
 
-func (p *Pipeline) CancelBuild(buildNumber int) error {
-	err := p.cancelBuild(p.ApiClient, &backend.PatchBuild{BuildNumber: buildNumber})
-	if err != nil {
-		return err
+// CancelResult is the outcome of a request to cancel a build
+type CancelResult int
+
+const (
+	// CancelResultCancelled is a build which was cancelled
+	CancelResultCancelled CancelResult = iota
+	// CancelResultAlreadyFinished is a build which finished before it could be cancelled
+	CancelResultAlreadyFinished
+	// CancelResultNotFound is a build Buildkite does not know
+	CancelResultNotFound
+)
+
+func (r CancelResult) String() string {
+	switch r {
+	case CancelResultCancelled:
+		return "cancelled"
+	case CancelResultAlreadyFinished:
+		return "already_finished"
+	case CancelResultNotFound:
+		return "not_found"
 	}
-	log.Debug().Int("buildNumber", buildNumber).Msg("Build cancelled")
-	return nil
+	return fmt.Sprintf("CancelResult(%d)", int(r))
+}
+
+func (r CancelResult) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
 }
 
-// CancelBuild cancels a build on a pipeline
-func (p *Pipeline) cancelBuild(c *http.Client, pb *backend.PatchBuild) error {
+// CancelBuild cancels a build on a pipeline. A build which already finished or does not exist is not an error
+func (p *Pipeline) CancelBuild(buildNumber int) (CancelResult, error) {
+	result, err := p.cancelBuild(p.ApiClient, &backend.PatchBuild{BuildNumber: buildNumber})
+	if err != nil {
+		return result, err
+	}
+	log.Debug().
+		Int("buildNumber", buildNumber).
+		Str("pipelineSlug", p.PipelineSlug).
+		Stringer("result", result).
+		Msg("Build cancel requested")
+	if result == CancelResultCancelled {
+		metricBuildsCancelled.Inc()
+	}
+	return result, nil
+}
 
+// cancelBuild requests PUT /organizations/{org}/pipelines/{pipeline}/builds/{number}/cancel
+func (p *Pipeline) cancelBuild(c *http.Client, pb *backend.PatchBuild) (CancelResult, error) {
 	req, err := http.NewRequest(
 		http.MethodPut,
 		p.ApiUrl.JoinPath([]string{
@@ -67,24 +164,31 @@ func (p *Pipeline) cancelBuild(c *http.Client, pb *backend.PatchBuild) error {
 			p.PipelineSlug,
 			"builds",
 			fmt.Sprintf("%d", pb.BuildNumber),
+			"cancel",
 		}...).String(),
 		nil,
 	)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	res, err := c.Do(req)
+	metricBuildkiteApiRequests.WithLabelValues("cancel_build", statusCodeLabel(res)).Inc()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer res.Body.Close()
-	if res.StatusCode == http.StatusOK {
-		return nil
+	switch res.StatusCode {
+	case http.StatusOK:
+		return CancelResultCancelled, nil
+	case http.StatusUnprocessableEntity:
+		// Buildkite refuses to cancel builds which are not running
+		return CancelResultAlreadyFinished, nil
+	case http.StatusNotFound:
+		return CancelResultNotFound, nil
 	}
 	data := map[string]string{}
 	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
 		log.Err(err).Msg("Failed to decode CancelBuild response body")
-		return err
 	}
 
 	log.Warn().
@@ -94,7 +198,56 @@ func (p *Pipeline) cancelBuild(c *http.Client, pb *backend.PatchBuild) error {
 		Int("buildNumber", pb.BuildNumber).
 		Int("statusCode", res.StatusCode).
 		Msg("Failed to cancel build")
-	return fmt.Errorf("failed to cancel build %d: %d", pb.BuildNumber, res.StatusCode)
+	return 0, fmt.Errorf("failed to cancel build %d: %d", pb.BuildNumber, res.StatusCode)
+}
+
+// GetBuild fetches a build of the pipeline from Buildkite
+func (p *Pipeline) GetBuild(buildNumber int) (*Build, error) {
+	req, err := http.NewRequest(
+		http.MethodGet,
+		p.ApiUrl.JoinPath([]string{
+			"organizations",
+			p.OrgSlug,
+			"pipelines",
+			p.PipelineSlug,
+			"builds",
+			fmt.Sprintf("%d", buildNumber),
+		}...).String(),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.ApiClient.Do(req)
+	metricBuildkiteApiRequests.WithLabelValues("get_build", statusCodeLabel(res)).Inc()
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get build %d: %d", buildNumber, res.StatusCode)
+	}
+	build := &Build{}
+	if err := json.NewDecoder(res.Body).Decode(build); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
 
+// Ping checks the Buildkite API is reachable with the configured token
+func (p *Pipeline) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.ApiUrl.JoinPath("access-token").String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.ApiClient.Do(req)
+	metricBuildkiteApiRequests.WithLabelValues("ping", statusCodeLabel(res)).Inc()
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("buildkite api returned %d", res.StatusCode)
+	}
 	return nil
 }
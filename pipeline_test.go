@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+)
+
+// fakeBuildkite is an httptest Buildkite REST API which records the requests it receives
+type fakeBuildkite struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+}
+
+func newFakeBuildkite(t *testing.T, mux *http.ServeMux) *fakeBuildkite {
+	t.Helper()
+	fake := &fakeBuildkite{}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		fake.requests = append(fake.requests, r.Method+" "+r.URL.Path)
+		fake.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (f *fakeBuildkite) pipeline(t *testing.T) *Pipeline {
+	t.Helper()
+	apiUrl, err := url.Parse(f.URL + "/v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Pipeline{
+		OrgSlug:      "my-org",
+		PipelineSlug: "my-pipeline",
+		ApiUrl:       apiUrl,
+		ApiClient:    f.Client(),
+	}
+}
+
+func TestCancelBuildContract(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /v2/organizations/my-org/pipelines/my-pipeline/builds/{build}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		switch r.PathValue("build") {
+		case "1":
+			json.NewEncoder(w).Encode(Build{Number: 1, State: "canceling"})
+		case "2":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Build can't be cancelled because it's already finished"})
+		case "4":
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Internal error"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "No build found"})
+		}
+	})
+	fake := newFakeBuildkite(t, mux)
+	p := fake.pipeline(t)
+
+	for _, tc := range []struct {
+		buildNumber int
+		result      CancelResult
+	}{
+		{1, CancelResultCancelled},
+		{2, CancelResultAlreadyFinished},
+		{3, CancelResultNotFound},
+	} {
+		result, err := p.CancelBuild(tc.buildNumber)
+		if err != nil {
+			t.Fatalf("Expected no error cancelling build %d, but got %v", tc.buildNumber, err)
+		}
+		if result != tc.result {
+			t.Errorf("Expected build %d to be %s, but got %s", tc.buildNumber, tc.result, result)
+		}
+	}
+	if _, err := p.CancelBuild(4); err == nil {
+		t.Error("Expected a server error to be returned")
+	}
+	if fake.requests[0] != "PUT /v2/organizations/my-org/pipelines/my-pipeline/builds/1/cancel" {
+		t.Errorf("Unexpected cancel request %s", fake.requests[0])
+	}
+}
+
+func TestGetBuildContract(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v2/organizations/my-org/pipelines/my-pipeline/builds/7", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Build{Number: 7, State: "passed", MetaData: map[string]string{"gerrit_change": "42"}})
+	})
+	fake := newFakeBuildkite(t, mux)
+	p := fake.pipeline(t)
+
+	build, err := p.GetBuild(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Number != 7 || build.State != "passed" || build.MetaData["gerrit_change"] != "42" {
+		t.Errorf("Unexpected build %+v", build)
+	}
+	if _, err := p.GetBuild(8); err == nil {
+		t.Error("Expected an unknown build to be an error")
+	}
+}
+
+func TestCreateBuildContract(t *testing.T) {
+	mux := http.NewServeMux()
+	var received buildkite.CreateBuild
+	mux.HandleFunc("POST /v2/organizations/my-org/pipelines/my-pipeline/builds", func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(Build{Number: 12, State: "scheduled"})
+	})
+	fake := newFakeBuildkite(t, mux)
+	p := fake.pipeline(t)
+
+	buildNumber, err := p.CreateBuild(&buildkite.CreateBuild{Commit: "abc123", Branch: "I123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buildNumber != 12 {
+		t.Errorf("Expected build 12, but got %d", buildNumber)
+	}
+	if received.Commit != "abc123" || received.Branch != "I123" {
+		t.Errorf("Unexpected build request %+v", received)
+	}
+}
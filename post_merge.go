@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// nullRev is the new revision of a deleted ref
+const nullRev = "0000000000000000000000000000000000000000"
+
+// PostMergeConfig configures builds of branches after changes are merged or pushed
+//
+//	post_merge:
+//	  branches: [main, "release/*"]
+//	  pipeline: trunk
+//	  report_on_change: true
+type PostMergeConfig struct {
+	// Branches are patterns of the branches to build. Ex: main or release/*. Empty disables post-merge builds
+	Branches []string `yaml:"branches"`
+	// Pipeline names the pipeline to build on. Empty uses the default pipeline
+	Pipeline string `yaml:"pipeline"`
+	// ReportOnChange posts the result of the build to the merged change without voting
+	ReportOnChange bool `yaml:"report_on_change"`
+}
+
+// BuildsBranch checks a branch matches one of the configured patterns
+func (c PostMergeConfig) BuildsBranch(branch string) bool {
+	for _, pattern := range c.Branches {
+		if ok, _ := path.Match(pattern, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the branch patterns and pipeline
+func (c PostMergeConfig) Validate(pipelines map[string]string) error {
+	for _, pattern := range c.Branches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("post_merge.branches pattern %q: %w", pattern, err)
+		}
+	}
+	if _, ok := pipelines[c.Pipeline]; c.Pipeline != "" && !ok {
+		return fmt.Errorf("post_merge uses unknown pipeline %q", c.Pipeline)
+	}
+	return nil
+}
+
+// refBranch returns the branch of a ref. Ex: refs/heads/main is main
+func refBranch(refName string) (string, bool) {
+	if branch, ok := strings.CutPrefix(refName, "refs/heads/"); ok {
+		return branch, true
+	}
+	// Older Gerrit versions send branch names without refs/heads/
+	return refName, !strings.HasPrefix(refName, "refs/")
+}
+
+// newPostMergeBuild describes a Buildkite build of a branch at a revision
+func newPostMergeBuild(branch, revision, message string, author *User) *buildkite.CreateBuild {
+	build := &buildkite.CreateBuild{
+		Commit:   revision,
+		Branch:   branch,
+		Message:  message,
+		MetaData: map[string]string{},
+	}
+	if author != nil {
+		build.Author = buildkite.Author{Name: author.Name, Email: author.Email}
+	}
+	return build
+}
+
+// HandleRefUpdated builds a branch updated by a push. Merged changes are built by HandleChangeMerged.
+func HandleRefUpdated(event Event, p BuildPipeline, b backend.Backend) error {
+	log.Debug().
+		Str("eventType", event.Type).
+		Str("refName", event.RefUpdate.RefName).
+		Str("newRev", event.RefUpdate.NewRev).
+		Msg("Ref updated")
+	branch, ok := refBranch(event.RefUpdate.RefName)
+	if !ok || event.RefUpdate.NewRev == nullRev || !config.PostMerge.BuildsBranch(branch) {
+		return nil
+	}
+	merged, err := gerritClient.QueryChanges(fmt.Sprintf("commit:%s status:merged", event.RefUpdate.NewRev))
+	if err != nil {
+		return err
+	}
+	if len(merged) > 0 {
+		log.Debug().
+			Str("branch", branch).
+			Str("newRev", event.RefUpdate.NewRev).
+			Int("change", merged[0].Number).
+			Msg("Branch updated by a merged change")
+		return nil
+	}
+	// Merges Gerrit has not indexed yet are built by the first of ref-updated and change-merged
+	if claimed, err := b.ClaimRevision(event.Context(), event.RefUpdate.NewRev); err != nil || !claimed {
+		return err
+	}
+	pipeline, err := pipelineByName(config.PostMerge.Pipeline, p)
+	if err != nil {
+		return err
+	}
+	log.Info().
+		Str("eventType", event.Type).
+		Str("branch", branch).
+		Str("newRev", event.RefUpdate.NewRev).
+		Str("pipeline", pipeline.Slug()).
+		Msg("Creating post-merge build of pushed branch")
+	build := newPostMergeBuild(branch, event.RefUpdate.NewRev, fmt.Sprintf("Post-merge build of %s", branch), event.Submitter)
+	_, err = createTracedBuild(pipeline, event, build)
+	return err
+}
+
+// HandleChangeMerged builds the branch of a merged change at the merged revision
+func HandleChangeMerged(event Event, p BuildPipeline, b backend.Backend) error {
+	branch := event.Change.Branch
+	if !config.PostMerge.BuildsBranch(branch) {
+		return nil
+	}
+	// A merge already built on ref-updated is not built again
+	if claimed, err := b.ClaimRevision(event.Context(), event.NewRev); err != nil || !claimed {
+		return err
+	}
+	pipeline, err := pipelineByName(config.PostMerge.Pipeline, p)
+	if err != nil {
+		return err
+	}
+	log.Info().
+		Str("eventType", event.Type).
+		Int("change", event.Change.Number).
+		Str("branch", branch).
+		Str("newRev", event.NewRev).
+		Str("pipeline", pipeline.Slug()).
+		Msg("Creating post-merge build of merged change")
+	message := fmt.Sprintf("Post-merge build of %s: %s\n\n%s", branch, event.Change.Subject, event.Change.URL)
+	build := newPostMergeBuild(branch, event.NewRev, message, event.Submitter)
+	build.MetaData["gerrit_change_url"] = event.Change.URL
+	pb := &backend.PatchBuild{
+		Pipeline: pipeline.Slug(),
+		State:    "scheduled",
+		Trigger:  backend.TriggerPostMerge,
+		Patch: &backend.Patch{
+			Number: event.PatchSet.Number,
+			Change: event.Change.Number,
+		},
+	}
+	if config.PostMerge.ReportOnChange {
+		tagBuildPatch(build.MetaData, pb, event.Change.Project)
+	}
+	pb.BuildNumber, err = createTracedBuild(pipeline, event, build)
+	if err != nil || !config.PostMerge.ReportOnChange {
+		return err
+	}
+	return saveBuild(b, event, pb)
+}
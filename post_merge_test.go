@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func TestRefBranch(t *testing.T) {
+	for _, tc := range []struct {
+		refName string
+		branch  string
+		ok      bool
+	}{
+		{"refs/heads/main", "main", true},
+		{"refs/heads/release/1.0", "release/1.0", true},
+		{"main", "main", true},
+		{"refs/changes/01/1/1", "", false},
+		{"refs/meta/config", "", false},
+	} {
+		branch, ok := refBranch(tc.refName)
+		if ok != tc.ok || (ok && branch != tc.branch) {
+			t.Errorf("refBranch(%q) = %q, %v; expected %q, %v", tc.refName, branch, ok, tc.branch, tc.ok)
+		}
+	}
+}
+
+func TestItBuildsPushedBranches(t *testing.T) {
+	c := defaultConfig()
+	c.PostMerge.Branches = []string{"main", "release/*"}
+	withConfig(t, c, map[string]BuildPipeline{})
+	withGerrit(t, NewMockGerritChanges(map[string][]QueriedChange{
+		"commit:def456 status:merged": {{Change: Change{Number: 42}}},
+	}))
+	p := NewMockPipeline()
+	var created *buildkite.CreateBuild
+	p.MockCreateBuild = func(build *buildkite.CreateBuild) (int, error) {
+		created = build
+		return 7, nil
+	}
+	b := NewMockBackend()
+
+	event := Event{Type: "ref-updated", RefUpdate: RefUpdate{RefName: "refs/heads/release/2.0", NewRev: "abc123"}}
+	if err := HandleRefUpdated(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if created == nil || created.Branch != "release/2.0" || created.Commit != "abc123" {
+		t.Fatalf("Expected a build of release/2.0 at abc123, but got %+v", created)
+	}
+	if b.FunctionCallCounter["SaveBuild"] != 0 {
+		t.Error("Expected a pushed branch build not to be saved")
+	}
+
+	for _, ignored := range []RefUpdate{
+		{RefName: "refs/heads/feature", NewRev: "abc123"},
+		{RefName: "refs/heads/main", NewRev: nullRev},
+		{RefName: "refs/changes/01/1/1", NewRev: "abc123"},
+	} {
+		p.Reset("CreateBuild")
+		HandleRefUpdated(Event{Type: "ref-updated", RefUpdate: ignored}, p, b)
+		if p.FunctionCallCounter["CreateBuild"] != 0 {
+			t.Errorf("Expected %+v not to be built", ignored)
+		}
+	}
+
+	// Merged changes are built on change-merged
+	p.Reset("CreateBuild")
+	HandleRefUpdated(Event{Type: "ref-updated", RefUpdate: RefUpdate{RefName: "refs/heads/main", NewRev: "def456"}}, p, b)
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Error("Expected a merged change not to be built on ref-updated")
+	}
+
+	// Revisions already built by change-merged are not built again
+	b.MockClaimRevision = func(ctx context.Context, revision string) (bool, error) {
+		return false, nil
+	}
+	p.Reset("CreateBuild")
+	HandleRefUpdated(Event{Type: "ref-updated", RefUpdate: RefUpdate{RefName: "refs/heads/main", NewRev: "abc123"}}, p, b)
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Error("Expected a claimed revision not to be built on ref-updated")
+	}
+}
+
+func TestItBuildsMergedChanges(t *testing.T) {
+	c := defaultConfig()
+	c.PostMerge.Branches = []string{"main"}
+	c.PostMerge.ReportOnChange = true
+	withConfig(t, c, map[string]BuildPipeline{})
+	p := NewMockPipeline()
+	var created *buildkite.CreateBuild
+	p.MockCreateBuild = func(build *buildkite.CreateBuild) (int, error) {
+		created = build
+		return 7, nil
+	}
+	b := NewMockBackend()
+	var claimed string
+	b.MockClaimRevision = func(ctx context.Context, revision string) (bool, error) {
+		claimed = revision
+		return true, nil
+	}
+	var saved *backend.PatchBuild
+	b.MockSaveBuild = func(ctx context.Context, pb *backend.PatchBuild) error {
+		saved = pb
+		return nil
+	}
+
+	event := Event{
+		Type:     "change-merged",
+		NewRev:   "def456",
+		Change:   Change{Number: 42, Branch: "main", URL: "https://gerrit/c/42"},
+		PatchSet: PatchSet{Number: 3},
+	}
+	if err := HandleChangeMerged(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if created == nil || created.Branch != "main" || created.Commit != "def456" || created.MetaData["gerrit_change_url"] != event.Change.URL {
+		t.Fatalf("Expected a build of main at def456 linking the change, but got %+v", created)
+	}
+	if claimed != "def456" {
+		t.Errorf("Expected def456 to be claimed, but got %q", claimed)
+	}
+	if saved == nil || saved.Trigger != backend.TriggerPostMerge || saved.Change != 42 {
+		t.Errorf("Expected a post-merge build of change 42 to be saved, but got %+v", saved)
+	}
+
+	// Merges already built on ref-updated are not built again
+	b.MockClaimRevision = func(ctx context.Context, revision string) (bool, error) {
+		return false, nil
+	}
+	p.Reset("CreateBuild")
+	if err := HandleChangeMerged(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Error("Expected a claimed merge not to be built again")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// MessagesConfig are text/template templates of review messages by build state.
+// Finished states without a template of their own use finished, and carried is posted when a result is carried forward.
+// Templates are executed with ReviewMessageData.
+//
+//	messages:
+//	  running: "Build {{ .PatchBuild.BuildNumber }} started"
+//	  failed: "[CI failed]({{ .Build.WebURL }}) after {{ .Duration }}"
+type MessagesConfig map[string]string
+
+// messageStates are the keys of MessagesConfig
+var messageStates = []string{"running", "finished", "carried", "passed", "soft_failed", "failed", "canceled", "skipped", "not_run", "blocked"}
+
+func defaultMessagesConfig() MessagesConfig {
+	return MessagesConfig{
+		"running": "Build {{ .PatchBuild.BuildNumber }} is running",
+		"finished": "[Build {{ .PatchBuild.BuildNumber }} {{ .Outcome.Result }}]({{ .Build.WebURL }}) " +
+			"{{ if .PostMerge }}after Change {{ .PatchBuild.Change }} was merged" +
+			"{{ else }}for Change {{ .PatchBuild.Change }} Patch {{ .PatchBuild.Number }}{{ end }}",
+		"carried": "{{ .Outcome.Result }}: carried from PS{{ .PatchBuild.Number }}, build {{ .PatchBuild.BuildNumber }} ({{ .Kind }})",
+	}
+}
+
+// ReviewMessageData is what message templates can use
+type ReviewMessageData struct {
+	Build      Build
+	PatchBuild *backend.PatchBuild
+	Outcome    BuildOutcome
+	// PostMerge is true for builds of a branch after a change was merged
+	PostMerge bool
+	// Created, Started and Finished are zero until Buildkite sets them
+	Created  time.Time
+	Started  time.Time
+	Finished time.Time
+	// Duration is the time from start to finish, to the second
+	Duration time.Duration
+	// Kind is the patch set kind a carried result was carried forward to. Ex: TRIVIAL_REBASE
+	Kind string
+}
+
+// parseBuildTime parses a Buildkite timestamp. An empty or invalid one is the zero time.
+func parseBuildTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// newReviewMessageData collects what message templates can use about a build
+func newReviewMessageData(build Build, pb *backend.PatchBuild) ReviewMessageData {
+	data := ReviewMessageData{
+		Build:      build,
+		PatchBuild: pb,
+		Outcome:    buildOutcome(build),
+		PostMerge:  pb.Trigger == backend.TriggerPostMerge,
+		Created:    parseBuildTime(build.CreatedAt),
+		Started:    parseBuildTime(build.StartedAt),
+		Finished:   parseBuildTime(build.FinishedAt),
+	}
+	if !data.Started.IsZero() && !data.Finished.IsZero() {
+		data.Duration = data.Finished.Sub(data.Started).Round(time.Second)
+	}
+	return data
+}
+
+// messageState is the MessagesConfig key of a build
+func messageState(build Build) string {
+	if build.State == "passed" && softFailed(build) {
+		return "soft_failed"
+	}
+	if build.State == "canceling" {
+		return "canceled"
+	}
+	return build.State
+}
+
+// Validate checks every template is of a known state, parses and renders for an empty build
+func (c MessagesConfig) Validate() error {
+	data := newReviewMessageData(Build{}, &backend.PatchBuild{Patch: &backend.Patch{}})
+	for state, text := range c {
+		if !slices.Contains(messageStates, state) {
+			return fmt.Errorf("messages.%s is not one of %s", state, strings.Join(messageStates, ", "))
+		}
+		if _, err := renderMessageTemplate(state, text, data); err != nil {
+			return fmt.Errorf("messages.%s: %w", state, err)
+		}
+	}
+	return nil
+}
+
+// renderMessageTemplate executes a message template
+func renderMessageTemplate(state, text string, data ReviewMessageData) (string, error) {
+	tmpl, err := template.New(state).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	out := &strings.Builder{}
+	if err := tmpl.Execute(out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// reviewMessage renders the message of a webhook event, running or finished, for a build.
+// The default template is used when the configured one fails.
+func reviewMessage(event string, build Build, pb *backend.PatchBuild) string {
+	state := "running"
+	if event != "build.running" {
+		state = messageState(build)
+		if _, ok := config.Messages[state]; !ok {
+			state = "finished"
+		}
+	}
+	return renderReviewMessage(state, newReviewMessageData(build, pb))
+}
+
+// carriedMessage renders the message of the result of a build carried forward to a patch set of a kind
+func carriedMessage(pb *backend.PatchBuild, kind string) string {
+	data := newReviewMessageData(Build{Number: pb.BuildNumber, State: pb.State}, pb)
+	data.Kind = kind
+	return renderReviewMessage("carried", data)
+}
+
+// renderReviewMessage renders the template of a state, or its default when the configured one fails
+func renderReviewMessage(state string, data ReviewMessageData) string {
+	pb := data.PatchBuild
+	message, err := renderMessageTemplate(state, config.Messages[state], data)
+	if err == nil {
+		return message
+	}
+	log.Error().
+		Err(err).
+		Str("template", "messages."+state).
+		Str("pipeline", pb.Pipeline).
+		Int("buildNumber", pb.BuildNumber).
+		Msg("Failed to render message template")
+	defaultState := state
+	if defaultState != "running" && defaultState != "carried" {
+		defaultState = "finished"
+	}
+	message, err = renderMessageTemplate(defaultState, defaultMessagesConfig()[defaultState], data)
+	if err != nil {
+		return fmt.Sprintf("Build %d %s", pb.BuildNumber, data.Outcome.Result)
+	}
+	return message
+}
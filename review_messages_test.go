@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func TestReviewMessage(t *testing.T) {
+	c := defaultConfig()
+	c.Messages["failed"] = "CI failed after {{ .Duration }} on {{ .Build.Branch }}"
+	withConfig(t, c, map[string]BuildPipeline{})
+	pb := &backend.PatchBuild{BuildNumber: 7, Patch: &backend.Patch{Change: 42, Number: 3}}
+	build := Build{
+		Number:     7,
+		State:      "passed",
+		Branch:     "main",
+		WebURL:     "https://buildkite.com/org/mock-pipeline/builds/7",
+		StartedAt:  "2026-01-02T10:00:00.000Z",
+		FinishedAt: "2026-01-02T10:01:30.400Z",
+	}
+
+	for _, tc := range []struct {
+		event   string
+		state   string
+		trigger string
+		message string
+	}{
+		{"build.running", "running", "", "Build 7 is running"},
+		{"build.finished", "passed", "", "[Build 7 Passed](https://buildkite.com/org/mock-pipeline/builds/7) for Change 42 Patch 3"},
+		{"build.finished", "passed", backend.TriggerPostMerge, "[Build 7 Passed](https://buildkite.com/org/mock-pipeline/builds/7) after Change 42 was merged"},
+		{"build.finished", "failed", "", "CI failed after 1m30s on main"},
+	} {
+		build.State = tc.state
+		pb.Trigger = tc.trigger
+		if message := reviewMessage(tc.event, build, pb); message != tc.message {
+			t.Errorf("Expected %s of a %s build to be %q, but got %q", tc.event, tc.state, tc.message, message)
+		}
+	}
+}
+
+func TestCarriedMessage(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	pb := &backend.PatchBuild{BuildNumber: 12, State: "passed", Patch: &backend.Patch{Change: 42, Number: 2}}
+	if message := carriedMessage(pb, "TRIVIAL_REBASE"); message != "Passed: carried from PS2, build 12 (TRIVIAL_REBASE)" {
+		t.Errorf("Unexpected default message %q", message)
+	}
+
+	c := defaultConfig()
+	c.Messages["carried"] = "Reused build {{ .PatchBuild.BuildNumber }} for this {{ .Kind }}"
+	withConfig(t, c, map[string]BuildPipeline{})
+	if message := carriedMessage(pb, "NO_CODE_CHANGE"); message != "Reused build 12 for this NO_CODE_CHANGE" {
+		t.Errorf("Unexpected configured message %q", message)
+	}
+}
+
+func TestReviewMessageData(t *testing.T) {
+	data := newReviewMessageData(Build{CreatedAt: "2026-01-02T09:59:00Z", StartedAt: "2026-01-02T10:00:00Z"}, &backend.PatchBuild{Patch: &backend.Patch{}})
+	if data.Created.IsZero() || data.Started.Sub(data.Created) != time.Minute {
+		t.Errorf("Unexpected timings %+v", data)
+	}
+	if !data.Finished.IsZero() || data.Duration != 0 {
+		t.Errorf("Expected an unfinished build to have no duration, but got %s", data.Duration)
+	}
+}
+
+func TestItRejectsInvalidMessageTemplates(t *testing.T) {
+	for _, messages := range []MessagesConfig{
+		{"failing": "Build is failing"},
+		{"failed": "{{ .Build.Nope }}"},
+		{"running": "{{ .Build.Number"},
+	} {
+		c := defaultConfig()
+		c.Messages = messages
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected messages %v to be invalid", messages)
+		}
+	}
+}
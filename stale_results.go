@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// Policies of results of superseded patch sets
+const (
+	// StalePolicyMessage posts the result without a vote
+	StalePolicyMessage = "message"
+	// StalePolicyDrop does not post the result
+	StalePolicyDrop = "drop"
+)
+
+// recordCurrentPatch saves the patch set of an event as the latest of its change
+func recordCurrentPatch(event Event, b backend.Backend) {
+	patch := &backend.Patch{
+		Number:   event.PatchSet.Number,
+		Change:   event.Change.Number,
+		Revision: event.PatchSet.Revision,
+	}
+	if err := b.SaveCurrentPatch(event.Context(), patch); err != nil {
+		log.Err(err).
+			Int("change", patch.Change).
+			Int("patch", patch.Number).
+			Msg("Failed to save current patch set")
+	}
+}
+
+// currentPatchSet returns the latest patch set number of a change from the backend,
+// or from Gerrit when the backend has no record and r can query changes
+func currentPatchSet(ctx context.Context, r GerritReviewWriter, b backend.Backend, change int) (int, error) {
+	current, err := b.GetCurrentPatch(ctx, change)
+	if err != backend.ErrPatchNotFound {
+		return current, err
+	}
+	querier, ok := r.(GerritChangeQuerier)
+	if !ok {
+		return 0, err
+	}
+	changes, err := querier.QueryChanges(fmt.Sprintf("change:%d", change))
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range changes {
+		if c.Number == change && c.CurrentPatchSet != nil {
+			return c.CurrentPatchSet.Number, nil
+		}
+	}
+	return 0, backend.ErrPatchNotFound
+}
+
+// supersedingPatchSet returns the patch set which superseded the patch set of a build.
+// Builds of merged changes and builds whose change is unknown are never stale.
+func supersedingPatchSet(ctx context.Context, r GerritReviewWriter, b backend.Backend, pb *backend.PatchBuild) (int, bool) {
+	if pb.Trigger == backend.TriggerPostMerge {
+		return 0, false
+	}
+	current, err := currentPatchSet(ctx, r, b, pb.Patch.Change)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Int("change", pb.Patch.Change).
+			Int("patch", pb.Patch.Number).
+			Msg("Failed to find current patch set, reporting the build as current")
+		return 0, false
+	}
+	return current, current > pb.Patch.Number
+}
+
+// reportStaleResult applies the stale result policy to a review of a superseded patch set.
+// It returns false when the review should not be posted.
+func reportStaleResult(review *Review, current int) bool {
+	log.Info().
+		Int("change", review.Change).
+		Int("patch", review.Number).
+		Int("currentPatch", current).
+		Str("policy", config.Results.Stale).
+		Msg("Build result of a superseded patch set")
+	// Nobody needs to act on a patch set which is no longer current
+	review.AddToAttentionSet = nil
+	review.RemoveFromAttentionSet = nil
+	review.Reviewers = nil
+	if config.Results.Stale == StalePolicyDrop {
+		return false
+	}
+	review.OmitVote = true
+	review.Message = fmt.Sprintf("%s (superseded by Patch %d)", review.Message, current)
+	return true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func TestItPostsStaleResultsWithoutVoting(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	b := NewMockBackend()
+	b.MockGetCurrentPatch = func(ctx context.Context, change int) (int, error) {
+		return 3, nil
+	}
+	g := NewMockGerrit()
+	var review *Review
+	g.MockSetReviewState = func(r *Review) error {
+		review = r
+		return nil
+	}
+	webhook := NewMockWebhook(&b, "build.finished", "failed", &backend.Patch{Change: 42, Number: 2})
+
+	if err := handleWebhookEvent(context.Background(), webhook, g, NewMockPipeline(), b); err != nil {
+		t.Fatal(err)
+	}
+	if review == nil || !review.OmitVote {
+		t.Fatalf("Expected the stale result to be posted without a vote, but got %+v", review)
+	}
+	if !strings.Contains(review.Message, "superseded by Patch 3") {
+		t.Errorf("Expected the message to name the current patch set, but got %q", review.Message)
+	}
+	if g.FunctionCallCounter["QueryChanges"] != 0 {
+		t.Error("Expected Gerrit not to be queried when the backend knows the current patch set")
+	}
+}
+
+func TestItDropsStaleResults(t *testing.T) {
+	c := defaultConfig()
+	c.Results.Stale = StalePolicyDrop
+	withConfig(t, c, map[string]BuildPipeline{})
+	b := NewMockBackend()
+	g := NewMockGerrit()
+	// The backend lost the current patch set so Gerrit is asked
+	g.MockQueryChanges = func(query string, options ...string) ([]QueriedChange, error) {
+		if query != "change:42" {
+			t.Errorf("Unexpected query %q", query)
+		}
+		return []QueriedChange{{Change: Change{Number: 42}, CurrentPatchSet: &PatchSet{Number: 3}}}, nil
+	}
+	webhook := NewMockWebhook(&b, "build.finished", "failed", &backend.Patch{Change: 42, Number: 2})
+
+	if err := handleWebhookEvent(context.Background(), webhook, g, NewMockPipeline(), b); err != nil {
+		t.Fatal(err)
+	}
+	if g.FunctionCallCounter["SetReviewState"] != 0 {
+		t.Error("Expected the stale result to be dropped")
+	}
+}
+
+func TestItVotesOnCurrentPatchSets(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	b := NewMockBackend()
+	b.MockGetCurrentPatch = func(ctx context.Context, change int) (int, error) {
+		return 2, nil
+	}
+	g := NewMockGerrit()
+	var review *Review
+	g.MockSetReviewState = func(r *Review) error {
+		review = r
+		return nil
+	}
+	webhook := NewMockWebhook(&b, "build.finished", "failed", &backend.Patch{Change: 42, Number: 2})
+
+	if err := handleWebhookEvent(context.Background(), webhook, g, NewMockPipeline(), b); err != nil {
+		t.Fatal(err)
+	}
+	if review == nil || review.OmitVote || review.State != ReviewStateRejected {
+		t.Errorf("Expected a vote on the current patch set, but got %+v", review)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// metaDataTopicPatches lists the $Patch_$Change slugs of every patch set of a topic build
+const metaDataTopicPatches = "gerrit_topic_patches"
+
+// TopicBuildsConfig builds the open changes of a topic together, for changes spanning several projects
+//
+//	topic_builds:
+//	  enabled: true
+//	  pipeline: cross-repo
+type TopicBuildsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Pipeline is the name of the pipeline of topic builds. Empty is the pipeline chosen for the change
+	Pipeline string `yaml:"pipeline"`
+}
+
+// Validate checks the pipeline exists
+func (c TopicBuildsConfig) Validate(pipelines map[string]string) error {
+	if _, ok := pipelines[c.Pipeline]; c.Pipeline != "" && !ok {
+		return fmt.Errorf("topic_builds uses unknown pipeline %q", c.Pipeline)
+	}
+	return nil
+}
+
+// topicChange is an open change of a topic and the patch set to build
+type topicChange struct {
+	Change   Change
+	PatchSet PatchSet
+}
+
+// queryPhrase quotes a value of a Gerrit search operator. Gerrit has no escapes so
+// values with double quotes are written in braces. Ex: topic:{say "hi"}
+func queryPhrase(value string) (string, error) {
+	switch {
+	case !strings.Contains(value, `"`):
+		return `"` + value + `"`, nil
+	case !strings.ContainsAny(value, "{}"):
+		return "{" + value + "}", nil
+	}
+	return "", fmt.Errorf("cannot quote %q in a Gerrit query", value)
+}
+
+// topicChanges returns the open changes of the topic of an event, the change of the event first
+func topicChanges(event Event) ([]topicChange, error) {
+	topic, err := queryPhrase(event.Change.Topic)
+	if err != nil {
+		return nil, err
+	}
+	queried, err := gerritClient.QueryChanges(fmt.Sprintf("topic:%s status:open", topic))
+	if err != nil {
+		return nil, err
+	}
+	changes := []topicChange{{Change: event.Change, PatchSet: event.PatchSet}}
+	for _, c := range queried {
+		if c.Number == event.Change.Number || c.CurrentPatchSet == nil || !c.Open {
+			continue
+		}
+		changes = append(changes, topicChange{Change: c.Change, PatchSet: *c.CurrentPatchSet})
+	}
+	sort.SliceStable(changes[1:], func(i, j int) bool {
+		return changes[1+i].Change.Number < changes[1+j].Change.Number
+	})
+	return changes, nil
+}
+
+// topicBuildPending checks a topic build which already includes the patch set of an event is not finished.
+// Changes pushed together to a topic would otherwise each start the same build.
+func topicBuildPending(event Event, b backend.Backend) bool {
+	pb, err := b.GetPatch(event.Context(), &backend.Patch{Number: event.PatchSet.Number, Change: event.Change.Number})
+	if err != nil || pb == nil {
+		return false
+	}
+	return pb.Trigger == backend.TriggerTopic && !buildFinished(pb.State)
+}
+
+// createTopicBuild builds the open changes of the topic of an event in one build, with the relation chain of the change of the event,
+// and saves it for each of them. It returns false when the change is alone in its topic.
+func createTopicBuild(event Event, p BuildPipeline, b backend.Backend, chain []dependency) (bool, error) {
+	if topicBuildPending(event, b) {
+		log.Info().
+			Int("change", event.Change.Number).
+			Int("patch", event.PatchSet.Number).
+			Str("topic", event.Change.Topic).
+			Msg("Patch set is already in a topic build")
+		return true, nil
+	}
+	changes, err := topicChanges(event)
+	if err != nil || len(changes) == 1 {
+		return false, err
+	}
+	pipeline, err := pipelineByName(config.TopicBuilds.Pipeline, p)
+	if err != nil {
+		return true, err
+	}
+
+	build := newCreateBuild(event)
+	refspecs, numbers, slugs := []string{}, []string{}, []string{}
+	pbs := []*backend.PatchBuild{}
+	for _, c := range changes {
+		refspecs = append(refspecs, fmt.Sprintf("%s:%s", c.Change.Project, c.PatchSet.Ref))
+		numbers = append(numbers, fmt.Sprint(c.Change.Number))
+		patch := &backend.Patch{Number: c.PatchSet.Number, Change: c.Change.Number, Revision: c.PatchSet.Revision}
+		slugs = append(slugs, patch.PatchSlug())
+		pbs = append(pbs, &backend.PatchBuild{
+			Pipeline: pipeline.Slug(),
+			State:    "scheduled",
+			Trigger:  backend.TriggerTopic,
+			Patch:    patch,
+		})
+	}
+	build.Env["GERRIT_TOPIC_REFSPECS"] = strings.Join(refspecs, " ")
+	build.Env["GERRIT_TOPIC_CHANGES"] = strings.Join(numbers, " ")
+	tagDependencies(build, chain)
+	if build.MetaData == nil {
+		build.MetaData = map[string]string{}
+	}
+	tagBuildPatch(build.MetaData, pbs[0], event.Change.Project)
+	build.MetaData[metaDataTopicPatches] = strings.Join(slugs, " ")
+
+	log.Info().
+		Str("eventType", event.Type).
+		Int("change", event.Change.Number).
+		Int("patch", event.PatchSet.Number).
+		Str("topic", event.Change.Topic).
+		Strs("changes", numbers).
+		Str("pipeline", pipeline.Slug()).
+		Msg("Creating topic build")
+	buildNumber, err := createTracedBuild(pipeline, event, build)
+	if err != nil {
+		return true, err
+	}
+	// The change of the event is saved last so webhooks find it first
+	failed := []error{}
+	for i := len(pbs) - 1; i >= 0; i-- {
+		pbs[i].BuildNumber = buildNumber
+		if err := saveBuild(b, event, pbs[i]); err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return true, errors.Join(failed...)
+}
+
+// topicPatchBuilds returns a copy of pb for every patch set of a topic build, or pb for other builds
+func topicPatchBuilds(build Build, pb *backend.PatchBuild) []*backend.PatchBuild {
+	slugs := strings.Fields(build.MetaData[metaDataTopicPatches])
+	if len(slugs) == 0 {
+		return []*backend.PatchBuild{pb}
+	}
+	pbs := []*backend.PatchBuild{}
+	for _, slug := range slugs {
+		patch, err := backend.NewPatch(slug)
+		if err != nil {
+			continue
+		}
+		topicPB := *pb
+		topicPB.Patch = patch
+		topicPB.Trigger = backend.TriggerTopic
+		pbs = append(pbs, &topicPB)
+	}
+	if !slices.ContainsFunc(pbs, func(topicPB *backend.PatchBuild) bool {
+		return topicPB.Change == pb.Change
+	}) {
+		pbs = append(pbs, pb)
+	}
+	return pbs
+}
+
+// forEachTopicPatch reports a build on each patch set it built, even when reporting on one fails
+func forEachTopicPatch(build Build, pb *backend.PatchBuild, report func(*backend.PatchBuild) error) error {
+	failed := []error{}
+	for _, topicPB := range topicPatchBuilds(build, pb) {
+		if err := report(topicPB); err != nil {
+			failed = append(failed, fmt.Errorf("change %d: %w", topicPB.Change, err))
+		}
+	}
+	return errors.Join(failed...)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func TestItBuildsTheOpenChangesOfATopicTogether(t *testing.T) {
+	c := defaultConfig()
+	c.TopicBuilds.Enabled = true
+	withConfig(t, c, map[string]BuildPipeline{})
+	withGerrit(t, NewMockGerritChanges(map[string][]QueriedChange{
+		`topic:"cross" status:open`: {
+			{Change: Change{Number: 43, Project: "api"}, Open: true, CurrentPatchSet: &PatchSet{Number: 1, Ref: "refs/changes/43/43/1"}},
+			{Change: Change{Number: 42, Project: "app"}, Open: true, CurrentPatchSet: &PatchSet{Number: 1, Ref: "refs/changes/42/42/1"}},
+			{Change: Change{Number: 41, Project: "lib"}, Open: true, CurrentPatchSet: &PatchSet{Number: 5, Ref: "refs/changes/41/41/5"}},
+		},
+	}))
+	p := NewMockPipeline()
+	var built *buildkite.CreateBuild
+	p.MockCreateBuild = func(build *buildkite.CreateBuild) (int, error) {
+		built = build
+		return 9, nil
+	}
+	b := NewMockBackend()
+	saved := []*backend.PatchBuild{}
+	b.MockSaveBuild = func(ctx context.Context, pb *backend.PatchBuild) error {
+		saved = append(saved, pb)
+		return nil
+	}
+
+	event := Event{
+		Type:     "patchset-created",
+		Change:   Change{Number: 42, Project: "app", Topic: "cross"},
+		PatchSet: PatchSet{Number: 2, Ref: "refs/changes/42/42/2"},
+	}
+	if err := HandlePatchsetCreated(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 1 {
+		t.Fatalf("Expected one build, but CreateBuild was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+	if refspecs := built.Env["GERRIT_TOPIC_REFSPECS"]; refspecs != "app:refs/changes/42/42/2 lib:refs/changes/41/41/5 api:refs/changes/43/43/1" {
+		t.Errorf("Unexpected refspecs %q", refspecs)
+	}
+	if patches := built.MetaData[metaDataTopicPatches]; patches != "2_42 5_41 1_43" {
+		t.Errorf("Unexpected topic patches %q", patches)
+	}
+	if len(saved) != 3 || saved[2].Change != 42 || saved[0].Trigger != backend.TriggerTopic || saved[0].BuildNumber != 9 {
+		t.Errorf("Expected the build to be saved for every change, the change of the event last")
+	}
+}
+
+func TestItBuildsChangesAloneInTheirTopicByThemselves(t *testing.T) {
+	c := defaultConfig()
+	c.TopicBuilds.Enabled = true
+	withConfig(t, c, map[string]BuildPipeline{})
+	withGerrit(t, NewMockGerritChanges(map[string][]QueriedChange{
+		`topic:"cross" status:open`: {{Change: Change{Number: 42}, Open: true, CurrentPatchSet: &PatchSet{Number: 1}}},
+	}))
+	p := NewMockPipeline()
+	var built *buildkite.CreateBuild
+	p.MockCreateBuild = func(build *buildkite.CreateBuild) (int, error) {
+		built = build
+		return 1, nil
+	}
+
+	event := Event{Type: "patchset-created", Change: Change{Number: 42, Topic: "cross"}, PatchSet: PatchSet{Number: 2}}
+	if err := HandlePatchsetCreated(event, p, NewMockBackend()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := built.MetaData[metaDataTopicPatches]; ok {
+		t.Error("Expected a change alone in its topic not to have a topic build")
+	}
+}
+
+func TestItDoesNotRebuildPatchSetsInAPendingTopicBuild(t *testing.T) {
+	c := defaultConfig()
+	c.TopicBuilds.Enabled = true
+	withConfig(t, c, map[string]BuildPipeline{})
+	g := NewMockGerrit()
+	withGerrit(t, g)
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	b.MockGetPatch = func(ctx context.Context, patch *backend.Patch) (*backend.PatchBuild, error) {
+		return &backend.PatchBuild{Patch: patch, BuildNumber: 9, State: "running", Trigger: backend.TriggerTopic}, nil
+	}
+
+	event := Event{Type: "patchset-created", Change: Change{Number: 43, Topic: "cross"}, PatchSet: PatchSet{Number: 1}}
+	if err := HandlePatchsetCreated(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 0 || g.FunctionCallCounter["QueryChanges"] != 0 {
+		t.Error("Expected the patch set not to be built again")
+	}
+}
+
+func TestItReportsTopicBuildsOnEveryChange(t *testing.T) {
+	withConfig(t, defaultConfig(), map[string]BuildPipeline{})
+	b := NewMockBackend()
+	webhook := NewMockWebhook(&b, "build.finished", "failed", &backend.Patch{Change: 42, Number: 2})
+	webhook.Build.MetaData = map[string]string{metaDataTopicPatches: "2_42 5_41 1_43"}
+	b.MockGetCurrentPatch = func(ctx context.Context, change int) (int, error) {
+		return map[int]int{41: 5, 42: 2, 43: 1}[change], nil
+	}
+	g := NewMockGerrit()
+	reviewed := []int{}
+	g.MockSetReviewState = func(r *Review) error {
+		reviewed = append(reviewed, r.Change)
+		if r.OmitVote || r.State != ReviewStateRejected {
+			t.Errorf("Expected change %d to be voted -1, but got %+v", r.Change, r)
+		}
+		return nil
+	}
+
+	if err := handleWebhookEvent(context.Background(), webhook, g, NewMockPipeline(), b); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(reviewed, []int{42, 41, 43}) {
+		t.Errorf("Expected every change of the topic to be reviewed, but got %v", reviewed)
+	}
+}
+
+func TestQueryPhrase(t *testing.T) {
+	for topic, expected := range map[string]string{
+		"cross":       `"cross"`,
+		`say "hi"`:    `{say "hi"}`,
+		"it's shared": `"it's shared"`,
+	} {
+		if phrase, err := queryPhrase(topic); err != nil || phrase != expected {
+			t.Errorf("queryPhrase(%q) = %q, %v; expected %q", topic, phrase, err, expected)
+		}
+	}
+	if _, err := queryPhrase(`{"}`); err == nil {
+		t.Error("Expected a topic with quotes and braces not to be quoted")
+	}
+	if quoted := shellQuote(`topic:"it's" status:open`); quoted != `'topic:"it'\''s" status:open'` {
+		t.Errorf("Unexpected shell quoting %s", quoted)
+	}
+}
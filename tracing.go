@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing follows a Gerrit event through its handlers, the Buildkite build it creates
+// and the webhook that reports the build back to Gerrit. The trace context is carried
+// to the webhook in the build meta-data.
+
+const tracerName = "github.com/mrmod/gerrit-buildkite"
+
+var tracer = otel.Tracer(tracerName)
+
+// setupTracing exports spans over OTLP/HTTP to endpoint. Tracing is a no-op when endpoint is empty.
+// The returned function flushes and stops the exporter.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("gerrit-event-handler"),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer(tracerName)
+	return provider.Shutdown, nil
+}
+
+// eventAttributes describes a Gerrit event on a span
+func eventAttributes(event Event) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("gerrit.event_type", event.Type),
+		attribute.String("gerrit.project", event.Change.Project),
+		attribute.Int("gerrit.change", event.Change.Number),
+		attribute.Int("gerrit.patchset", event.PatchSet.Number),
+	}
+}
+
+// startEventSpan starts the root span of a Gerrit event and returns the event carrying it
+func startEventSpan(event Event) (Event, trace.Span) {
+	ctx, span := tracer.Start(event.Context(), "gerrit.event "+event.Type,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(eventAttributes(event)...),
+	)
+	return event.WithContext(ctx), span
+}
+
+// endSpan records err on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// injectTraceContext writes the trace context of ctx into Buildkite build meta-data
+func injectTraceContext(ctx context.Context, metaData map[string]string) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(metaData))
+}
+
+// extractTraceContext reads a trace context written by injectTraceContext
+func extractTraceContext(ctx context.Context, metaData map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(metaData))
+}
+
+// startWebhookSpan starts a span for a Buildkite webhook continuing the trace of the Gerrit event which created the build
+func startWebhookSpan(webhook BuildkiteWebhook) (context.Context, trace.Span) {
+	ctx := extractTraceContext(context.Background(), webhook.Build.MetaData)
+	return tracer.Start(ctx, "buildkite.webhook "+webhook.Event,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.Int("buildkite.build_number", webhook.Build.Number),
+			attribute.String("buildkite.build_state", webhook.Build.State),
+		),
+	)
+}
+
+// setReviewState writes a review to Gerrit in a span of the trace in ctx
+func setReviewState(ctx context.Context, r GerritReviewWriter, review *Review) error {
+	_, span := tracer.Start(ctx, "gerrit.set_review_state", trace.WithAttributes(
+		attribute.Int("gerrit.change", review.Patch.Change),
+		attribute.Int("gerrit.patchset", review.Patch.Number),
+		attribute.Int("gerrit.review_state", review.State),
+	))
+	err := r.SetReviewState(review)
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/buildkite/go-buildkite/buildkite"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func useTestTracer(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracer
+	tracer = provider.Tracer(tracerName)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { tracer = previous })
+	return recorder
+}
+
+func TestItCarriesTheEventTraceToTheWebhook(t *testing.T) {
+	recorder := useTestTracer(t)
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	var created *buildkite.CreateBuild
+	p.MockCreateBuild = func(build *buildkite.CreateBuild) (int, error) {
+		created = build
+		return 1, nil
+	}
+
+	event, span := startEventSpan(Event{
+		Type:     "patchset-created",
+		PatchSet: PatchSet{Number: 1, Revision: "123456"},
+		Change:   Change{Number: 9999},
+	})
+	if err := HandlePatchsetCreated(event, p, b); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	span.End()
+
+	if created.MetaData["traceparent"] == "" {
+		t.Fatalf("Expected the build meta-data to carry the trace, but got %v", created.MetaData)
+	}
+
+	_, webhookSpan := startWebhookSpan(BuildkiteWebhook{
+		Event: "build.finished",
+		Build: Build{Number: 1, MetaData: created.MetaData},
+	})
+	webhookSpan.End()
+
+	traceID := event.TraceID()
+	for _, s := range recorder.Ended() {
+		if s.SpanContext().TraceID().String() != traceID {
+			t.Errorf("Expected span %s to be in trace %s, but was in %s", s.Name(), traceID, s.SpanContext().TraceID())
+		}
+	}
+	if len(recorder.Ended()) != 4 {
+		t.Errorf("Expected the event, create build, save build and webhook spans, but got %d spans", len(recorder.Ended()))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+	"github.com/rs/zerolog/log"
+)
+
+// VoteTrigger creates a build when a label is changed to a value
+//
+//	vote_triggers:
+//	  - label: Code-Review
+//	    value: 2
+//	    pipeline: full-ci
+type VoteTrigger struct {
+	Label string `yaml:"label"`
+	Value int    `yaml:"value"`
+	// Pipeline names the pipeline to build on. Empty uses the pipeline chosen by the hashtags of the change
+	Pipeline string `yaml:"pipeline"`
+}
+
+// parseVote parses a label value written by Gerrit. Ex: 2, +2 or -1
+func parseVote(value string) (int, error) {
+	return strconv.Atoi(strings.TrimPrefix(value, "+"))
+}
+
+// Matches checks an approval changed the label of the trigger to its value.
+// Gerrit only sets the old value of labels changed by the comment so repeated votes never match.
+func (t VoteTrigger) Matches(approval Approval) bool {
+	if !strings.EqualFold(approval.Type, t.Label) || approval.OldValue == "" {
+		return false
+	}
+	value, err := parseVote(approval.Value)
+	if err != nil {
+		return false
+	}
+	oldValue, err := parseVote(approval.OldValue)
+	if err != nil {
+		return false
+	}
+	return value == t.Value && oldValue != value
+}
+
+// HandleVoteTriggers creates a build for each vote trigger matched by the approvals of a comment
+func HandleVoteTriggers(event Event, p BuildPipeline, b backend.Backend) error {
+	if reason, ignored := commentIgnored(event); ignored {
+		log.Debug().
+			Int("change", event.Change.Number).
+			Str("reason", reason).
+			Msg("Ignoring votes")
+		return nil
+	}
+	// Each pipeline builds once however many triggers match
+	triggered := map[string]bool{}
+	for _, trigger := range config.VoteTriggers {
+		for _, approval := range event.Approvals {
+			if !trigger.Matches(approval) || triggered[trigger.Pipeline] {
+				continue
+			}
+			triggered[trigger.Pipeline] = true
+			log.Info().
+				Str("eventType", event.Type).
+				Int("patch", event.PatchSet.Number).
+				Int("change", event.Change.Number).
+				Str("label", approval.Type).
+				Str("value", approval.Value).
+				Str("oldValue", approval.OldValue).
+				Str("pipeline", trigger.Pipeline).
+				Msg("Vote triggered build")
+			// Skip hashtags do not stop votes, but topics and relation chains still apply
+			if err := createPipelineBuild(event, trigger.Pipeline, p, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateVoteTriggers checks each trigger names a label and a known pipeline
+func validateVoteTriggers(triggers []VoteTrigger, pipelines map[string]string) error {
+	for i, trigger := range triggers {
+		if trigger.Label == "" {
+			return fmt.Errorf("vote_triggers[%d] has no label", i)
+		}
+		if _, ok := pipelines[trigger.Pipeline]; trigger.Pipeline != "" && !ok {
+			return fmt.Errorf("vote_triggers[%d] uses unknown pipeline %q", i, trigger.Pipeline)
+		}
+	}
+	return nil
+}
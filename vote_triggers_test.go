@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mrmod/gerrit-buildkite/backend"
+)
+
+func TestVoteTriggerMatches(t *testing.T) {
+	trigger := VoteTrigger{Label: "Code-Review", Value: 2}
+	for _, tc := range []struct {
+		approval Approval
+		expected bool
+	}{
+		{Approval{Type: "Code-Review", Value: "2", OldValue: "0"}, true},
+		{Approval{Type: "Code-Review", Value: "+2", OldValue: "1"}, true},
+		// Repeating a vote leaves the old value unset
+		{Approval{Type: "Code-Review", Value: "2"}, false},
+		{Approval{Type: "Code-Review", Value: "2", OldValue: "2"}, false},
+		{Approval{Type: "Code-Review", Value: "1", OldValue: "0"}, false},
+		{Approval{Type: "Verified", Value: "2", OldValue: "0"}, false},
+	} {
+		if matched := trigger.Matches(tc.approval); matched != tc.expected {
+			t.Errorf("Matches(%+v) = %v; expected %v", tc.approval, matched, tc.expected)
+		}
+	}
+
+	reset := VoteTrigger{Label: "Verified", Value: 0}
+	if !reset.Matches(Approval{Type: "Verified", Value: "0", OldValue: "-1"}) {
+		t.Error("Expected a reset of Verified to match")
+	}
+}
+
+func TestItBuildsOnTheTriggeredPipeline(t *testing.T) {
+	c := defaultConfig()
+	c.VoteTriggers = []VoteTrigger{
+		{Label: "Code-Review", Value: 2},
+		{Label: "Run-Integration", Value: 1, Pipeline: "integration"},
+	}
+	integration := NewMockPipeline()
+	integration.MockSlug = "integration-pipeline"
+	withConfig(t, c, map[string]BuildPipeline{"integration": integration})
+	p := NewMockPipeline()
+	b := NewMockBackend()
+
+	event := Event{
+		Type: "comment-added",
+		Approvals: []Approval{
+			{Type: "Code-Review", Value: "2"},
+			{Type: "Run-Integration", Value: "1", OldValue: "0"},
+		},
+	}
+	if err := HandleVoteTriggers(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 0 || integration.FunctionCallCounter["CreateBuild"] != 1 {
+		t.Errorf("Expected a build on integration only, but default=%d integration=%d", p.FunctionCallCounter["CreateBuild"], integration.FunctionCallCounter["CreateBuild"])
+	}
+
+	// Votes by the bridge never trigger builds
+	event.Approvals[0].OldValue = "0"
+	event.Tag = "autogenerated:buildkite"
+	HandleVoteTriggers(event, p, b)
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Errorf("Expected autogenerated votes to be ignored, but CreateBuild was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+}
+
+func TestItDoesNotRebuildAPendingTopicBuildOnVotes(t *testing.T) {
+	c := defaultConfig()
+	c.VoteTriggers = []VoteTrigger{{Label: "Code-Review", Value: 2}}
+	c.TopicBuilds.Enabled = true
+	withConfig(t, c, map[string]BuildPipeline{})
+	p := NewMockPipeline()
+	b := NewMockBackend()
+	b.MockGetPatch = func(ctx context.Context, patch *backend.Patch) (*backend.PatchBuild, error) {
+		return &backend.PatchBuild{BuildNumber: 3, State: "running", Trigger: backend.TriggerTopic, Patch: patch}, nil
+	}
+
+	event := Event{
+		Type:      "comment-added",
+		Change:    Change{Number: 42, Topic: "cross"},
+		PatchSet:  PatchSet{Number: 1},
+		Approvals: []Approval{{Type: "Code-Review", Value: "2", OldValue: "1"}},
+	}
+	if err := HandleVoteTriggers(event, p, b); err != nil {
+		t.Fatal(err)
+	}
+	if p.FunctionCallCounter["CreateBuild"] != 0 {
+		t.Errorf("Expected the running topic build to be kept, but CreateBuild was called %d times", p.FunctionCallCounter["CreateBuild"])
+	}
+}
+
+func TestItRejectsVoteTriggersOnUnknownPipelines(t *testing.T) {
+	c := defaultConfig()
+	c.VoteTriggers = []VoteTrigger{{Label: "Code-Review", Value: 2, Pipeline: "missing"}}
+	if err := c.Validate(); err == nil {
+		t.Error("Expected an unknown pipeline to be rejected")
+	}
+}